@@ -2,36 +2,127 @@ package main
 
 import (
   "os"
+  "io"
   "fmt"
   "log"
   "net"
+  "flag"
+  "time"
   "bufio"
+  "strings"
+  "math/rand"
+  "encoding/binary"
+
+  "github.com/CodingAnarchy/dominion/lib/dns"
 )
 
-func main() {
-  fmt.Println("Starting client...")
-  conn, err := net.Dial("tcp", "localhost:8080")
+var server = flag.String("server", "localhost:8053", "address of the Dominion DNS server")
+
+// query asks the server for the records of one type for name, over UDP and
+// then over TCP if the answer was truncated.
+func query(name string, typ uint16) (reply *dns.Message, err error) {
+  msg, err := (&dns.Message{
+    Header: dns.Header{ID: uint16(rand.Intn(1 << 16)), RecursionDesired: true},
+    Questions: []dns.Question{{Name: name, Type: typ, Class: dns.ClassINET}},
+  }).Pack()
+  if err != nil {
+    return
+  }
+
+  conn, err := net.DialTimeout("udp", *server, 5 * time.Second)
+  if err != nil {
+    return
+  }
+  defer conn.Close()
+  conn.SetDeadline(time.Now().Add(5 * time.Second))
+  if _, err = conn.Write(msg); err != nil {
+    return
+  }
+  buf := make([]byte, dns.MaxUDPSize)
+  n, err := conn.Read(buf)
+  if err != nil {
+    return
+  }
+  if reply, err = dns.Unpack(buf[:n]); err != nil || !reply.Truncated {
+    return
+  }
+  return queryTCP(msg)
+}
+
+// queryTCP sends a packed query over TCP with its 2 byte length prefix.
+func queryTCP(msg []byte) (*dns.Message, error) {
+  conn, err := net.DialTimeout("tcp", *server, 5 * time.Second)
   if err != nil {
-    log.Fatal("Connection error: ", err)
+    return nil, err
   }
-  server_reply := bufio.NewReader(conn)
-  server_writer := bufio.NewWriter(conn)
-  input := bufio.NewReader(os.Stdin)
+  defer conn.Close()
+  conn.SetDeadline(time.Now().Add(5 * time.Second))
+  if _, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+    return nil, err
+  }
+  var length uint16
+  if err = binary.Read(conn, binary.BigEndian, &length); err != nil {
+    return nil, err
+  }
+  buf := make([]byte, length)
+  if _, err = io.ReadFull(conn, buf); err != nil {
+    return nil, err
+  }
+  return dns.Unpack(buf)
+}
+
+func main() {
+  flag.Parse()
+  fmt.Println("Starting client...")
+  // DNS message IDs come from math/rand, so each client needs its own seed
+  rand.Seed(time.Now().UnixNano())
+  defer func() {
+    if node != nil {
+      node.Close()
+    }
+  }()
+  input := bufio.NewScanner(os.Stdin)
   for {
-    fmt.Print("Enter message: ")
-    in, _ := input.ReadString('\n')
-    _, err = server_writer.WriteString(in)
-    if err != nil {
-      log.Fatal("Error writing to connection: ", err)
+    fmt.Print("Enter domain [type], or delete domain [type]: ")
+    if !input.Scan() {
+      return
+    }
+    fields := strings.Fields(input.Text())
+    if len(fields) == 0 {
+      continue
+    }
+    if fields[0] == "delete" {
+      if len(fields) < 2 || len(fields) > 3 {
+        fmt.Println("Usage: delete domain [type]")
+      } else if err := deleteRecords(fields[1], fields[2:]...); err != nil {
+        log.Println("Error deleting records: ", err)
+      }
+      continue
+    }
+    typ := dns.TypeA
+    if len(fields) > 1 {
+      var ok bool
+      if typ, ok = dns.StringType(fields[1]); !ok {
+        fmt.Println("Unknown record type:", fields[1])
+        continue
+      }
     }
-    server_writer.Flush()
 
-    reply, err := server_reply.ReadString('\n')
+    reply, err := query(fields[0], typ)
     if err != nil {
-      conn.Close()
-      log.Fatal("Error getting server response: ", err)
+      log.Println("Error querying server: ", err)
+      continue
+    }
+    switch {
+    case reply.Rcode == dns.RcodeNameError:
+      fmt.Println(fields[0], "does not exist (NXDOMAIN)")
+    case reply.Rcode != dns.RcodeSuccess:
+      fmt.Println("Server returned error code", reply.Rcode)
+    case len(reply.Answers) == 0:
+      fmt.Println("No", dns.TypeString(typ), "records for", fields[0])
+    }
+    for _, answer := range reply.Answers {
+      fmt.Println(answer.Name, answer.TTL, dns.TypeString(answer.Type), answer.DataString())
     }
-    fmt.Print(reply)
-
   }
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+  "fmt"
+  "flag"
+  "strings"
+  "context"
+
+  "github.com/CodingAnarchy/dominion/lib/dns"
+  "github.com/CodingAnarchy/dominion/lib/kademlia"
+)
+
+var (
+  dhtAddr   = flag.String("dht", "127.0.0.1:4001", "address to serve the Kademlia DHT on while deleting records")
+  networkID = flag.String("network", "dominion", "Kademlia network ID to join")
+  seedList  = flag.String("seeds", "localhost:4000", "comma separated bootstrap contacts, as address or nodeid@address")
+  transport = flag.String("transport", "rpc", "DHT transport to use: rpc (net/rpc over HTTP) or udp")
+  keyFile   = flag.String("key", "dominion.key", "file holding the key that owns the records to delete")
+)
+
+// node is the DHT node deletions are made through, joined on first use
+var node *kademlia.Kademlia
+
+// joinNetwork joins the DHT the first time records are deleted.
+func joinNetwork() error {
+  if node != nil {
+    return nil
+  }
+  seeds, err := kademlia.ParseSeedList(*seedList)
+  if err != nil {
+    return err
+  }
+  // A throwaway identity, only needed for as long as the client runs
+  key, err := kademlia.NewNodeKey(kademlia.DefaultNodeDifficulty)
+  if err != nil {
+    return err
+  }
+  k := kademlia.NewKademlia(key, *dhtAddr, *networkID)
+  switch *transport {
+  case "rpc":
+  case "udp":
+    k.Transport = kademlia.NewUDPTransport()
+  default:
+    return fmt.Errorf("Unknown transport: %s", *transport)
+  }
+  if err := k.Join(context.Background(), seeds...); err != nil {
+    k.Close()
+    return err
+  }
+  node = k
+  return nil
+}
+
+// deleteRecords deletes the records of one type for name from the DHT, or all
+// of its records if no type is given, signing the tombstones with the key
+// from the -key flag.
+func deleteRecords(name string, types ...string) error {
+  for i, typ := range types {
+    if t, ok := dns.StringType(typ); ok {
+      types[i] = dns.TypeString(t)
+    } else {
+      return fmt.Errorf("Unknown record type: %s", typ)
+    }
+  }
+  // Deleting needs the key that owns the records, so never make a new one
+  owner, err := kademlia.ReadKey(*keyFile)
+  if err != nil {
+    return err
+  }
+  if err := joinNetwork(); err != nil {
+    return fmt.Errorf("Error joining network: %s", err)
+  }
+  name = strings.TrimSuffix(name, ".")
+  if err := node.Delete(context.Background(), owner, name, types...); err != nil {
+    return err
+  }
+  if len(types) == 0 {
+    fmt.Println("Deleted all records for", name)
+  } else {
+    fmt.Println("Deleted", types[0], "records for", name)
+  }
+  return nil
+}
@@ -0,0 +1,342 @@
+// Package dns reads and writes DNS messages in the RFC 1035 wire format.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Record types
+const (
+	TypeA     uint16 = 1
+	TypeNS    uint16 = 2
+	TypeCNAME uint16 = 5
+	TypeSOA   uint16 = 6
+	TypeMX    uint16 = 15
+	TypeTXT   uint16 = 16
+	TypeAAAA  uint16 = 28
+	TypeSRV   uint16 = 33
+	TypeOPT   uint16 = 41
+	TypeANY   uint16 = 255
+	TypeCAA   uint16 = 257
+)
+
+// ClassINET is the Internet class, the only one Dominion serves.
+const ClassINET uint16 = 1
+
+// Response codes
+const (
+	RcodeSuccess        uint8 = 0
+	RcodeFormatError    uint8 = 1
+	RcodeServerFailure  uint8 = 2
+	RcodeNameError      uint8 = 3 // NXDOMAIN
+	RcodeNotImplemented uint8 = 4
+	RcodeRefused        uint8 = 5
+)
+
+// OpcodeQuery is the opcode of a standard query.
+const OpcodeQuery uint8 = 0
+
+// MaxUDPSize is the largest message sent over UDP.  Larger buffers advertised
+// in EDNS0 OPT records are not read, so it applies to every client.
+const MaxUDPSize = 512
+
+const (
+	headerLen   = 12
+	maxLabelLen = 63
+	maxNameLen  = 255
+)
+
+var errTruncated = errors.New("Message truncated")
+
+var typeNames = map[uint16]string{
+	TypeA:     "A",
+	TypeNS:    "NS",
+	TypeCNAME: "CNAME",
+	TypeSOA:   "SOA",
+	TypeMX:    "MX",
+	TypeTXT:   "TXT",
+	TypeAAAA:  "AAAA",
+	TypeSRV:   "SRV",
+	TypeOPT:   "OPT",
+	TypeANY:   "ANY",
+	TypeCAA:   "CAA",
+}
+
+// TypeString returns the mnemonic for a record type, such as "A" or "MX".
+func TypeString(typ uint16) string {
+	if name, ok := typeNames[typ]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", typ)
+}
+
+// StringType returns the record type for a mnemonic such as "A" or "MX".
+func StringType(name string) (uint16, bool) {
+	name = strings.ToUpper(name)
+	for typ, typName := range typeNames {
+		if typName == name {
+			return typ, true
+		}
+	}
+	return 0, false
+}
+
+// Header holds the fixed fields at the start of every message.
+type Header struct {
+	ID                 uint16
+	Response           bool
+	Opcode             uint8
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	Rcode              uint8
+}
+
+// Question asks for the records of one type for a name.
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// Resource is a resource record with its data left in wire format.
+type Resource struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// Message is a complete DNS query or response.
+type Message struct {
+	Header
+	Questions   []Question
+	Answers     []Resource
+	Authorities []Resource
+	Additionals []Resource
+}
+
+// NewReply creates an empty response to query, echoing its ID and questions.
+func NewReply(query *Message) *Message {
+	return &Message{
+		Header: Header{
+			ID:               query.ID,
+			Response:         true,
+			Opcode:           query.Opcode,
+			RecursionDesired: query.RecursionDesired,
+		},
+		Questions: query.Questions,
+	}
+}
+
+// AddressRecord creates an A or AAAA record for ip, depending on its family.
+func AddressRecord(name string, ttl uint32, ip net.IP) Resource {
+	if ip4 := ip.To4(); ip4 != nil {
+		return Resource{name, TypeA, ClassINET, ttl, []byte(ip4)}
+	}
+	return Resource{name, TypeAAAA, ClassINET, ttl, []byte(ip.To16())}
+}
+
+// IP returns the address held by an A or AAAA record, or nil for other types.
+func (r *Resource) IP() net.IP {
+	if (r.Type == TypeA && len(r.Data) == net.IPv4len) || (r.Type == TypeAAAA && len(r.Data) == net.IPv6len) {
+		return net.IP(r.Data)
+	}
+	return nil
+}
+
+// Pack encodes the message in wire format.  Names are written uncompressed.
+func (m *Message) Pack() (msg []byte, err error) {
+	msg = make([]byte, headerLen, MaxUDPSize)
+	binary.BigEndian.PutUint16(msg[0:], m.ID)
+	binary.BigEndian.PutUint16(msg[2:], m.flags())
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(msg[8:], uint16(len(m.Authorities)))
+	binary.BigEndian.PutUint16(msg[10:], uint16(len(m.Additionals)))
+
+	for _, q := range m.Questions {
+		if msg, err = packName(msg, q.Name); err != nil {
+			return nil, err
+		}
+		msg = binary.BigEndian.AppendUint16(msg, q.Type)
+		msg = binary.BigEndian.AppendUint16(msg, q.Class)
+	}
+	for _, section := range [][]Resource{m.Answers, m.Authorities, m.Additionals} {
+		for _, r := range section {
+			if msg, err = packResource(msg, &r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return
+}
+
+func (h *Header) flags() (flags uint16) {
+	flags = uint16(h.Opcode&0xF)<<11 | uint16(h.Rcode&0xF)
+	if h.Response {
+		flags |= 1 << 15
+	}
+	if h.Authoritative {
+		flags |= 1 << 10
+	}
+	if h.Truncated {
+		flags |= 1 << 9
+	}
+	if h.RecursionDesired {
+		flags |= 1 << 8
+	}
+	if h.RecursionAvailable {
+		flags |= 1 << 7
+	}
+	return
+}
+
+func packResource(msg []byte, r *Resource) (ret []byte, err error) {
+	if len(r.Data) > 0xFFFF {
+		return nil, fmt.Errorf("Record data for %s too long: %d bytes", r.Name, len(r.Data))
+	}
+	if msg, err = packName(msg, r.Name); err != nil {
+		return nil, err
+	}
+	msg = binary.BigEndian.AppendUint16(msg, r.Type)
+	msg = binary.BigEndian.AppendUint16(msg, r.Class)
+	msg = binary.BigEndian.AppendUint32(msg, r.TTL)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(r.Data)))
+	return append(msg, r.Data...), nil
+}
+
+// packName appends a name as a sequence of length-prefixed labels.  The
+// trailing root dot is optional.
+func packName(msg []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name)+2 > maxNameLen {
+		return nil, fmt.Errorf("Name too long: %s", name)
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > maxLabelLen {
+				return nil, fmt.Errorf("Invalid label in name %s", name)
+			}
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+	}
+	return append(msg, 0), nil
+}
+
+// Unpack decodes a message in wire format.
+func Unpack(msg []byte) (m *Message, err error) {
+	if len(msg) < headerLen {
+		return nil, errTruncated
+	}
+	m = new(Message)
+	m.ID = binary.BigEndian.Uint16(msg[0:])
+	flags := binary.BigEndian.Uint16(msg[2:])
+	m.Response = flags&(1<<15) != 0
+	m.Opcode = uint8(flags>>11) & 0xF
+	m.Authoritative = flags&(1<<10) != 0
+	m.Truncated = flags&(1<<9) != 0
+	m.RecursionDesired = flags&(1<<8) != 0
+	m.RecursionAvailable = flags&(1<<7) != 0
+	m.Rcode = uint8(flags & 0xF)
+
+	off := headerLen
+	for i := binary.BigEndian.Uint16(msg[4:]); i > 0; i-- {
+		var q Question
+		if q.Name, off, err = unpackName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+4 > len(msg) {
+			return nil, errTruncated
+		}
+		q.Type = binary.BigEndian.Uint16(msg[off:])
+		q.Class = binary.BigEndian.Uint16(msg[off+2:])
+		off += 4
+		m.Questions = append(m.Questions, q)
+	}
+
+	for i, section := range []*[]Resource{&m.Answers, &m.Authorities, &m.Additionals} {
+		for count := binary.BigEndian.Uint16(msg[6+2*i:]); count > 0; count-- {
+			var r Resource
+			if r, off, err = unpackResource(msg, off); err != nil {
+				return nil, err
+			}
+			*section = append(*section, r)
+		}
+	}
+	return
+}
+
+func unpackResource(msg []byte, off int) (r Resource, next int, err error) {
+	if r.Name, off, err = unpackName(msg, off); err != nil {
+		return
+	}
+	if off+10 > len(msg) {
+		return r, 0, errTruncated
+	}
+	r.Type = binary.BigEndian.Uint16(msg[off:])
+	r.Class = binary.BigEndian.Uint16(msg[off+2:])
+	r.TTL = binary.BigEndian.Uint32(msg[off+4:])
+	length := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if off+length > len(msg) {
+		return r, 0, errTruncated
+	}
+	r.Data = append([]byte(nil), msg[off:off+length]...)
+	if err = r.expandNames(msg, off); err != nil {
+		return r, 0, err
+	}
+	return r, off + length, nil
+}
+
+// unpackName reads a possibly compressed name starting at off, returning it
+// with a trailing root dot along with the offset just past it.
+func unpackName(msg []byte, off int) (name string, next int, err error) {
+	var labels []string
+	length := 0
+	next = -1
+	for hops := 0; ; hops++ {
+		if off >= len(msg) {
+			return "", 0, errTruncated
+		}
+		c := int(msg[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				if next < 0 {
+					next = off + 1
+				}
+				return strings.Join(labels, ".") + ".", next, nil
+			}
+			if off+1+c > len(msg) {
+				return "", 0, errTruncated
+			}
+			if length += c + 1; length > maxNameLen {
+				return "", 0, fmt.Errorf("Name too long at offset %d", off)
+			}
+			labels = append(labels, string(msg[off+1:off+1+c]))
+			off += 1 + c
+		case 0xC0:
+			// A pointer to a name earlier in the message
+			if off+2 > len(msg) {
+				return "", 0, errTruncated
+			}
+			if hops > len(msg) {
+				return "", 0, fmt.Errorf("Compression loop at offset %d", off)
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			return "", 0, fmt.Errorf("Invalid label type at offset %d", off)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// A query for www.google.com A, as sent by dig with EDNS disabled
+var googleQuery = []byte{
+	0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x03, 'w', 'w', 'w', 0x06, 'g', 'o', 'o', 'g', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+	0x00, 0x01, 0x00, 0x01,
+}
+
+func TestUnpackQuery(t *testing.T) {
+	m, err := Unpack(googleQuery)
+	if err != nil {
+		t.Fatalf("Error unpacking query: %s", err)
+	}
+	if m.ID != 0x1234 || m.Response || !m.RecursionDesired || m.Opcode != OpcodeQuery {
+		t.Errorf("Unexpected header %+v", m.Header)
+	}
+	if len(m.Questions) != 1 {
+		t.Fatalf("Expected 1 question, obtained %d", len(m.Questions))
+	}
+	if q := m.Questions[0]; q.Name != "www.google.com." || q.Type != TypeA || q.Class != ClassINET {
+		t.Errorf("Unexpected question %+v", q)
+	}
+}
+
+func TestPackQuery(t *testing.T) {
+	m := &Message{
+		Header:    Header{ID: 0x1234, RecursionDesired: true},
+		Questions: []Question{{"www.google.com", TypeA, ClassINET}},
+	}
+	msg, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Error packing query: %s", err)
+	}
+	if !bytes.Equal(msg, googleQuery) {
+		t.Errorf("Expected %x, obtained %x", googleQuery, msg)
+	}
+}
+
+func TestReplyRoundTrip(t *testing.T) {
+	query, _ := Unpack(googleQuery)
+	reply := NewReply(query)
+	reply.Authoritative = true
+	reply.Answers = append(reply.Answers,
+		AddressRecord("www.google.com.", 300, net.ParseIP("74.125.224.72")),
+		AddressRecord("www.google.com.", 300, net.ParseIP("2607:f8b0:4005:802::1010")))
+
+	msg, err := reply.Pack()
+	if err != nil {
+		t.Fatalf("Error packing reply: %s", err)
+	}
+	m, err := Unpack(msg)
+	if err != nil {
+		t.Fatalf("Error unpacking reply: %s", err)
+	}
+
+	if m.ID != query.ID || !m.Response || !m.Authoritative || !m.RecursionDesired || m.Rcode != RcodeSuccess {
+		t.Errorf("Unexpected header %+v", m.Header)
+	}
+	if len(m.Questions) != 1 || len(m.Answers) != 2 {
+		t.Fatalf("Expected 1 question and 2 answers, obtained %d and %d", len(m.Questions), len(m.Answers))
+	}
+	if a := m.Answers[0]; a.Type != TypeA || a.TTL != 300 || !a.IP().Equal(net.ParseIP("74.125.224.72")) {
+		t.Errorf("Unexpected A answer %+v", a)
+	}
+	if a := m.Answers[1]; a.Type != TypeAAAA || !a.IP().Equal(net.ParseIP("2607:f8b0:4005:802::1010")) {
+		t.Errorf("Unexpected AAAA answer %+v", a)
+	}
+}
+
+func TestUnpackCompressed(t *testing.T) {
+	// A reply whose answer name points back at the question name
+	msg := append([]byte{
+		0x12, 0x34, 0x81, 0x80, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+	}, googleQuery[12:]...)
+	msg = append(msg,
+		0xC0, 0x0C, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2C, 0x00, 0x04, 74, 125, 224, 72)
+
+	m, err := Unpack(msg)
+	if err != nil {
+		t.Fatalf("Error unpacking compressed reply: %s", err)
+	}
+	if len(m.Answers) != 1 || m.Answers[0].Name != "www.google.com." || m.Answers[0].TTL != 300 {
+		t.Errorf("Unexpected answers %+v", m.Answers)
+	}
+}
+
+func TestUnpackMalformed(t *testing.T) {
+	for name, msg := range map[string][]byte{
+		"short header":   googleQuery[:8],
+		"short question": googleQuery[:len(googleQuery)-2],
+		"long label":     append(append([]byte{}, googleQuery[:12]...), 0x40),
+		"pointer loop":   {0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 0x0C, 0, 1, 0, 1},
+		"missing answer": {0, 0, 0x80, 0, 0, 0, 0, 1, 0, 0, 0, 0},
+	} {
+		if _, err := Unpack(msg); err == nil {
+			t.Errorf("Expected error unpacking %s", name)
+		}
+	}
+}
+
+func TestPackInvalidName(t *testing.T) {
+	for _, name := range []string{"www..google.com", string(make([]byte, 64)) + ".com"} {
+		m := &Message{Questions: []Question{{name, TypeA, ClassINET}}}
+		if _, err := m.Pack(); err == nil {
+			t.Errorf("Expected error packing name %q", name)
+		}
+	}
+}
+
+func TestTypeString(t *testing.T) {
+	if TypeString(TypeMX) != "MX" || TypeString(999) != "TYPE999" {
+		t.Errorf("Unexpected type names %s and %s", TypeString(TypeMX), TypeString(999))
+	}
+	if typ, ok := StringType("aaaa"); !ok || typ != TypeAAAA {
+		t.Errorf("Expected AAAA type, obtained %d", typ)
+	}
+	if _, ok := StringType("BOGUS"); ok {
+		t.Errorf("Expected unknown type for BOGUS")
+	}
+}
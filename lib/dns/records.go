@@ -0,0 +1,139 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// NameRecord creates a record whose data is a single name, such as a CNAME or
+// NS record.
+func NameRecord(name string, typ uint16, ttl uint32, target string) (Resource, error) {
+	data, err := packName(nil, target)
+	return Resource{name, typ, ClassINET, ttl, data}, err
+}
+
+// MXRecord creates a mail exchange record.
+func MXRecord(name string, ttl uint32, preference uint16, exchange string) (Resource, error) {
+	data, err := packName(binary.BigEndian.AppendUint16(nil, preference), exchange)
+	return Resource{name, TypeMX, ClassINET, ttl, data}, err
+}
+
+// SRVRecord creates a service location record as described in RFC 2782.
+func SRVRecord(name string, ttl uint32, priority, weight, port uint16, target string) (Resource, error) {
+	data := binary.BigEndian.AppendUint16(nil, priority)
+	data = binary.BigEndian.AppendUint16(data, weight)
+	data = binary.BigEndian.AppendUint16(data, port)
+	data, err := packName(data, target)
+	return Resource{name, TypeSRV, ClassINET, ttl, data}, err
+}
+
+// TXTRecord creates a text record holding one or more strings of up to 255
+// bytes each.
+func TXTRecord(name string, ttl uint32, text []string) (Resource, error) {
+	if len(text) == 0 {
+		return Resource{}, fmt.Errorf("TXT record for %s has no strings", name)
+	}
+	var data []byte
+	for _, s := range text {
+		if len(s) > 255 {
+			return Resource{}, fmt.Errorf("TXT string for %s too long: %d bytes", name, len(s))
+		}
+		data = append(append(data, byte(len(s))), s...)
+	}
+	return Resource{name, TypeTXT, ClassINET, ttl, data}, nil
+}
+
+// CAARecord creates a certification authority authorization record as
+// described in RFC 8659.
+func CAARecord(name string, ttl uint32, flags uint8, tag string, value string) (Resource, error) {
+	if tag == "" || len(tag) > 15 {
+		return Resource{}, fmt.Errorf("Invalid CAA tag %q for %s", tag, name)
+	}
+	data := append([]byte{flags, byte(len(tag))}, tag...)
+	return Resource{name, TypeCAA, ClassINET, ttl, append(data, value...)}, nil
+}
+
+// DataString formats the record data in the presentation format of zone
+// files, such as "10 mail.example.com." for an MX record.  Data that cannot
+// be parsed is shown in the generic format of RFC 3597.
+func (r *Resource) DataString() string {
+	if s, ok := r.dataString(); ok {
+		return s
+	}
+	return fmt.Sprintf("\\# %d %x", len(r.Data), r.Data)
+}
+
+func (r *Resource) dataString() (string, bool) {
+	data := r.Data
+	switch r.Type {
+	case TypeA, TypeAAAA:
+		if ip := r.IP(); ip != nil {
+			return ip.String(), true
+		}
+	case TypeCNAME, TypeNS:
+		if name, next, err := unpackName(data, 0); err == nil && next == len(data) {
+			return name, true
+		}
+	case TypeMX:
+		if len(data) > 2 {
+			if name, next, err := unpackName(data, 2); err == nil && next == len(data) {
+				return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(data), name), true
+			}
+		}
+	case TypeSRV:
+		if len(data) > 6 {
+			if name, next, err := unpackName(data, 6); err == nil && next == len(data) {
+				return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(data),
+					binary.BigEndian.Uint16(data[2:]), binary.BigEndian.Uint16(data[4:]), name), true
+			}
+		}
+	case TypeTXT:
+		var text []string
+		for len(data) > 0 {
+			n := int(data[0])
+			if 1+n > len(data) {
+				return "", false
+			}
+			text = append(text, strconv.Quote(string(data[1:1+n])))
+			data = data[1+n:]
+		}
+		return strings.Join(text, " "), len(text) > 0
+	case TypeCAA:
+		if len(data) >= 2 && 2+int(data[1]) <= len(data) {
+			tag := string(data[2 : 2+int(data[1])])
+			return fmt.Sprintf("%d %s %s", data[0], tag, strconv.Quote(string(data[2+len(tag):]))), true
+		}
+	}
+	return "", false
+}
+
+// expandNames rewrites the data of record types that may hold compressed
+// names so that it no longer refers to the rest of the message.  off is the
+// offset of the data within msg.
+func (r *Resource) expandNames(msg []byte, off int) (err error) {
+	var prefix int
+	switch r.Type {
+	case TypeCNAME, TypeNS:
+		prefix = 0
+	case TypeMX:
+		prefix = 2
+	case TypeSRV:
+		prefix = 6
+	default:
+		return nil
+	}
+	if len(r.Data) <= prefix {
+		return errTruncated
+	}
+	name, next, err := unpackName(msg, off+prefix)
+	if err != nil {
+		return
+	}
+	if next != off+len(r.Data) {
+		return fmt.Errorf("Trailing data in %s record for %s", TypeString(r.Type), r.Name)
+	}
+	r.Data, err = packName(r.Data[:prefix:prefix], name)
+	return
+}
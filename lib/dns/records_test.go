@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	mx, _ := MXRecord("example.com.", 300, 10, "mail.example.com")
+	srv, _ := SRVRecord("_sip._tcp.example.com.", 300, 1, 2, 5060, "sip.example.com.")
+	cname, _ := NameRecord("www.example.com.", TypeCNAME, 300, "example.com")
+	ns, _ := NameRecord("example.com.", TypeNS, 300, "ns1.example.com")
+	txt, _ := TXTRecord("example.com.", 300, []string{"v=spf1 -all", "hello \"world\""})
+	caa, _ := CAARecord("example.com.", 300, 0, "issue", "letsencrypt.org")
+	records := []Resource{AddressRecord("example.com.", 300, net.ParseIP("93.184.216.34")), mx, srv, cname, ns, txt, caa}
+	expected := []string{
+		"93.184.216.34",
+		"10 mail.example.com.",
+		"1 2 5060 sip.example.com.",
+		"example.com.",
+		"ns1.example.com.",
+		`"v=spf1 -all" "hello \"world\""`,
+		`0 issue "letsencrypt.org"`,
+	}
+
+	msg, err := (&Message{Header: Header{Response: true}, Answers: records}).Pack()
+	if err != nil {
+		t.Fatalf("Error packing records: %s", err)
+	}
+	m, err := Unpack(msg)
+	if err != nil {
+		t.Fatalf("Error unpacking records: %s", err)
+	}
+	if len(m.Answers) != len(expected) {
+		t.Fatalf("Expected %d answers, obtained %d", len(expected), len(m.Answers))
+	}
+	for i, a := range m.Answers {
+		if s := a.DataString(); s != expected[i] {
+			t.Errorf("Expected %s data %q, obtained %q", TypeString(a.Type), expected[i], s)
+		}
+	}
+}
+
+func TestUnpackCompressedRecordData(t *testing.T) {
+	// An MX answer whose exchange points back at the question name
+	msg := []byte{
+		0x12, 0x34, 0x81, 0x80, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+		0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x0F, 0x00, 0x01,
+		0xC0, 0x0C, 0x00, 0x0F, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2C, 0x00, 0x09,
+		0x00, 0x0A, 0x04, 'm', 'a', 'i', 'l', 0xC0, 0x0C,
+	}
+	m, err := Unpack(msg)
+	if err != nil {
+		t.Fatalf("Error unpacking reply: %s", err)
+	}
+	if s := m.Answers[0].DataString(); s != "10 mail.example.com." {
+		t.Errorf("Expected expanded exchange, obtained %q", s)
+	}
+}
+
+func TestInvalidRecords(t *testing.T) {
+	if _, err := TXTRecord("example.com.", 300, nil); err == nil {
+		t.Errorf("Expected error for TXT record with no strings")
+	}
+	if _, err := CAARecord("example.com.", 300, 0, "", "letsencrypt.org"); err == nil {
+		t.Errorf("Expected error for CAA record with no tag")
+	}
+	if _, err := NameRecord("example.com.", TypeCNAME, 300, "bad..name"); err == nil {
+		t.Errorf("Expected error for CNAME to an invalid name")
+	}
+	bad := Resource{"example.com.", TypeMX, ClassINET, 300, []byte{0x00}}
+	if s := bad.DataString(); s != `\# 1 00` {
+		t.Errorf("Expected generic format for malformed data, obtained %q", s)
+	}
+}
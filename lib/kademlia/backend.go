@@ -0,0 +1,46 @@
+package kademlia
+
+import "time"
+
+// Backend saves the record sets a DomainStore holds so that they survive the
+// node restarting.  The DomainStore keeps every record in memory as well and
+// serializes its calls, so a Backend only needs to be read when opened.
+type Backend interface {
+	// Load returns every record saved and not deleted since.
+	Load() ([]StoredRecord, error)
+
+	// Save replaces any record saved for the same domain and type.
+	Save(record StoredRecord) error
+
+	// Delete forgets the record saved for a domain and type.
+	Delete(domain string, typ string) error
+
+	// Close releases the backend's files.
+	Close() error
+}
+
+// StoredRecord is a record set as saved by a Backend, along with the timers
+// that keep it alive.
+type StoredRecord struct {
+	Domain     string
+	Type       string
+	Set        RecordSet
+	Expires    time.Time // zero for records that do not expire locally
+	Replicated time.Time // last time the record was sent to or received from the network
+	Published  bool      // whether this node is the original publisher
+}
+
+// memoryBackend saves nothing, leaving records only in the DomainStore's
+// memory.
+type memoryBackend struct{}
+
+// NewMemoryBackend creates a backend under which records are lost when the
+// node exits.
+func NewMemoryBackend() Backend {
+	return memoryBackend{}
+}
+
+func (memoryBackend) Load() ([]StoredRecord, error)          { return nil, nil }
+func (memoryBackend) Save(record StoredRecord) error         { return nil }
+func (memoryBackend) Delete(domain string, typ string) error { return nil }
+func (memoryBackend) Close() error                           { return nil }
@@ -1,13 +1,42 @@
 package kademlia
 
 import (
+	"crypto/ed25519"
 	"fmt"
 )
 
-// Contact represents a node id and address record in the DHT
+// Contact represents a node id and address record in the DHT, along with the
+// public key the id is derived from when known
 type Contact struct {
 	id      NodeID
 	address string
+	key     ed25519.PublicKey
+}
+
+// NewContact creates a contact for the node with the given id reachable at address.
+func NewContact(id NodeID, address string) Contact {
+	return Contact{id: id, address: address}
+}
+
+// newKeyedContact creates a contact for the node holding a key, reachable at
+// address.
+func newKeyedContact(key ed25519.PublicKey, address string) Contact {
+	return Contact{NodeIDFromKey(key), address, key}
+}
+
+// ID returns the node id of the contact.
+func (contact *Contact) ID() NodeID {
+	return contact.id
+}
+
+// Address returns the network address of the contact.
+func (contact *Contact) Address() string {
+	return contact.address
+}
+
+// Key returns the public key of the contact, or nil if it is not known.
+func (contact *Contact) Key() ed25519.PublicKey {
+	return contact.key
 }
 
 func (contact *Contact) String() string {
@@ -18,3 +47,29 @@ func (contact *Contact) String() string {
 func (contact *Contact) Less(other interface{}) bool {
 	return contact.id.Less(other.(*Contact).id)
 }
+
+// GobEncode encodes the contact as its id, the length of its key, its key and
+// its address, so contacts can be carried in RPC messages without exporting
+// their fields.
+func (contact *Contact) GobEncode() ([]byte, error) {
+	data := make([]byte, idLength, idLength+1+len(contact.key)+len(contact.address))
+	copy(data, contact.id[:])
+	data = append(data, byte(len(contact.key)))
+	data = append(data, contact.key...)
+	return append(data, contact.address...), nil
+}
+
+// GobDecode decodes a contact encoded by GobEncode.
+func (contact *Contact) GobDecode(data []byte) error {
+	if len(data) < idLength+1 || len(data) < idLength+1+int(data[idLength]) {
+		return fmt.Errorf("Contact data too short: %d bytes", len(data))
+	}
+	copy(contact.id[:], data[:idLength])
+	data = data[idLength:]
+	contact.key = nil
+	if length := int(data[0]); length > 0 {
+		contact.key = ed25519.PublicKey(append([]byte(nil), data[1:1+length]...))
+	}
+	contact.address = string(data[1+len(contact.key):])
+	return nil
+}
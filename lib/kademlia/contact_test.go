@@ -1,12 +1,46 @@
 package kademlia
 
-import "testing"
+import (
+  "bytes"
+  "crypto/ed25519"
+  "encoding/gob"
+  "testing"
+)
 
 func TestContact(t *testing.T) {
-  a := &Contact{NewNodeID("FFFFFFFF00000000000000000000000000000000"), "localhost:8000"}
-  b := &Contact{NewNodeID("1111111100000000000000000000000000000000"), "localhost:8001"}
+  a := &Contact{id: NewNodeID("FFFFFFFF00000000000000000000000000000000"), address: "localhost:8000"}
+  b := &Contact{id: NewNodeID("1111111100000000000000000000000000000000"), address: "localhost:8001"}
 
   if !b.Less(a) {
     t.Errorf("Expected %s to be less than %s", b, a)
   }
 }
+
+func TestContactGob(t *testing.T) {
+  a := NewContact(NewNodeID("FFFFFFFF00000000000000000000000000000000"), "localhost:8000")
+  var buf bytes.Buffer
+  if err := gob.NewEncoder(&buf).Encode(&a); err != nil {
+    t.Fatalf("Error encoding %s: %s", &a, err)
+  }
+
+  var b Contact
+  if err := gob.NewDecoder(&buf).Decode(&b); err != nil {
+    t.Fatalf("Error decoding %s: %s", &a, err)
+  }
+  if !b.ID().Equals(a.ID()) || b.Address() != a.Address() || b.Key() != nil {
+    t.Errorf("Expected %s after round trip, obtained %s", &a, &b)
+  }
+
+  // A contact's key travels with it
+  c := newKeyedContact(testKey.Public().(ed25519.PublicKey), "localhost:8001")
+  buf.Reset()
+  if err := gob.NewEncoder(&buf).Encode(&c); err != nil {
+    t.Fatalf("Error encoding %s: %s", &c, err)
+  }
+  if err := gob.NewDecoder(&buf).Decode(&b); err != nil {
+    t.Fatalf("Error decoding %s: %s", &c, err)
+  }
+  if !b.ID().Equals(c.ID()) || b.Address() != c.Address() || !b.Key().Equal(c.Key()) {
+    t.Errorf("Expected %s with its key after round trip, obtained %s", &c, &b)
+  }
+}
@@ -1,31 +1,253 @@
 package kademlia
 
-import "net"
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
 
-// DomainStore type contains a mapping of domain records to IP addresses.
+// Record timers from the Kademlia paper
+const (
+	expireInterval    = 24*time.Hour + 10*time.Second // lifetime of a replicated record
+	replicateInterval = time.Hour                     // holders re-store records this often
+	republishInterval = 24 * time.Hour                // original publishers re-store records this often
+
+	// Tombstones are kept until every replica of the set they delete has
+	// expired, and long enough for its publisher to find one when it next
+	// republishes the set
+	tombstoneGracePeriod = republishInterval + expireInterval
+)
+
+// DomainStore type contains a mapping of domain records to their record sets, safe for concurrent use.
+// Every change is also written through to its Backend.
 type DomainStore struct {
-	data map[string]map[string]net.IP
+	mutex   sync.Mutex
+	data    map[string]map[string]*domainRecord
+	backend Backend
+}
+
+// domainRecord is a stored record set along with the timers that keep it alive.
+type domainRecord struct {
+	set        RecordSet
+	expires    time.Time // zero for records we published ourselves, other than registrations and tombstones
+	replicated time.Time // last time the record was sent to or received from the network
+	published  bool      // whether this node is the original publisher
+}
+
+// dueRecord is a record that should be sent out to the network again.
+type dueRecord struct {
+	domain    string
+	typ       string
+	set       RecordSet
+	ttl       time.Duration
+	published bool // whether this node is the original publisher
 }
 
 // NewDomainStore creates a new DomainStore type for storing domain record mapping.
 func NewDomainStore() (ret *DomainStore) {
 	ret = new(DomainStore)
-	ret.data = make(map[string]map[string]net.IP)
+	ret.data = make(map[string]map[string]*domainRecord)
+	ret.backend = NewMemoryBackend()
 	return
 }
 
-func (d *DomainStore) storeRecord(domain string, typ string, ip net.IP) {
+// open loads the records saved in a backend and writes changes through to it
+// from then on.
+func (d *DomainStore) open(backend Backend) error {
+	records, err := backend.Load()
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.backend = backend
+	for _, r := range records {
+		d.insert(r.Domain, r.Type, &domainRecord{r.Set, r.Expires, r.Replicated, r.Published})
+	}
+	return nil
+}
+
+// put holds a record for the domain and type, saving it to the backend first;
+// the store must already be locked.
+func (d *DomainStore) put(domain string, typ string, record *domainRecord) error {
+	domain, typ = normalizeDomain(domain), normalizeType(typ)
+	if err := d.save(domain, typ, record); err != nil {
+		return err
+	}
+	d.insert(domain, typ, record)
+	return nil
+}
+
+func (d *DomainStore) insert(domain string, typ string, record *domainRecord) {
 	if d.data[domain] == nil {
-		d.data[domain] = make(map[string]net.IP)
+		d.data[domain] = make(map[string]*domainRecord)
+	}
+	d.data[domain][typ] = record
+}
+
+func (d *DomainStore) save(domain string, typ string, record *domainRecord) error {
+	return d.backend.Save(StoredRecord{domain, typ, record.set, record.expires, record.replicated, record.published})
+}
+
+// claim returns the record held for the domain and type, failing if the new
+// set may not replace it; the store must already be locked.  Any set may only
+// be replaced by a newer version from the same owner.  A registration from
+// another owner never replaces an unexpired one, so the first claim a replica
+// sees is the one it keeps, and is only accepted if it was signed within
+// registrationSkew of now so that nobody can claim to have come first by
+// backdating.  Other sets from a different owner replace the one held, as the
+// caller has checked them against the domain's registration.
+func (d *DomainStore) claim(domain string, typ string, set *RecordSet, now time.Time) (old *domainRecord, err error) {
+	old = d.data[normalizeDomain(domain)][normalizeType(typ)]
+	if old != nil && old.expired(now) {
+		old = nil
 	}
-	d.data[domain][typ] = ip
+	if old != nil && bytes.Equal(old.set.Owner, set.Owner) {
+		if old.set.supersedes(set) {
+			err = ErrStaleRecord
+		}
+	} else if normalizeType(typ) == RegistrationType {
+		if old != nil {
+			err = ErrNotOwner
+		} else if registered := set.Records[0].Registered; registered.Before(now.Add(-registrationSkew)) {
+			err = fmt.Errorf("Registration for %s was signed at %s, too long ago to be a new claim", domain, registered)
+		}
+	}
+	return
 }
 
-func (d *DomainStore) retrieve(domain string, typ string) (ip net.IP) {
-	if d.data[domain] == nil || d.data[domain][typ] == nil {
-		ip = nil
-	} else {
-		ip = d.data[domain][typ]
+// storeRecord stores a copy of a signed record set received from the network,
+// which replaces any set held for the domain and type and expires after ttl
+// unless it is stored again.  Sets with a bad signature, or that claim
+// rejects, are refused.
+func (d *DomainStore) storeRecord(domain string, typ string, set RecordSet, ttl time.Duration) (err error) {
+	if err = set.Verify(domain, typ); err != nil {
+		return
+	}
+	// A tombstone is kept for its grace period, and a registration not past
+	// its own expiry
+	limit := expireInterval
+	if set.Deleted {
+		limit = tombstoneGracePeriod
+	}
+	if ttl <= 0 || ttl > limit {
+		ttl = limit
+	}
+	now := time.Now()
+	if normalizeType(typ) == RegistrationType {
+		if remaining := set.Records[0].Expires.Sub(now); remaining < ttl {
+			ttl = remaining
+		}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	old, err := d.claim(domain, typ, &set, now)
+	if err != nil {
+		return
+	}
+	// A replica of our own record coming back to us does not end our
+	// ownership, and leaves our own timers for it alone
+	if old != nil && old.published && old.set.Sequence == set.Sequence && sameRecords(old.set.Records, set.Records) {
+		return nil
+	}
+	return d.put(domain, typ, &domainRecord{set, now.Add(ttl), now, false})
+}
+
+// publishRecord stores a signed record set that this node is the original
+// publisher of.  Published records are republished daily and do not expire
+// locally, except for registrations, which last until their own expiry, and
+// tombstones, which are dropped after their grace period.
+func (d *DomainStore) publishRecord(domain string, typ string, set RecordSet) (err error) {
+	if err = set.Verify(domain, typ); err != nil {
+		return
+	}
+	now := time.Now()
+	var expires time.Time
+	if normalizeType(typ) == RegistrationType {
+		expires = set.Records[0].Expires
+	} else if set.Deleted {
+		expires = now.Add(tombstoneGracePeriod)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, err = d.claim(domain, typ, &set, now); err != nil {
+		return
+	}
+	return d.put(domain, typ, &domainRecord{set, expires, now, true})
+}
+
+// retrieve returns the set held for the domain and type, which may be a
+// tombstone, or an empty set if there is none.
+func (d *DomainStore) retrieve(domain string, typ string) (set RecordSet) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	record := d.data[normalizeDomain(domain)][normalizeType(typ)]
+	if record != nil && !record.expired(time.Now()) {
+		set = record.set
+	}
+	return
+}
+
+func (record *domainRecord) expired(now time.Time) bool {
+	return !record.expires.IsZero() && !now.Before(record.expires)
+}
+
+// expire drops every record whose lifetime has passed.
+func (d *DomainStore) expire(now time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for domain, types := range d.data {
+		for typ, record := range types {
+			if !record.expired(now) {
+				continue
+			}
+			if err := d.backend.Delete(domain, typ); err != nil {
+				log.Printf("Error deleting expired %s records for %s: %s\n", typ, domain, err)
+				continue
+			}
+			delete(types, typ)
+		}
+		if len(types) == 0 {
+			delete(d.data, domain)
+		}
+	}
+}
+
+// due returns the records that should be sent out to the network again: our
+// own records once a day, and those we hold for others once an hour.
+func (d *DomainStore) due(now time.Time) (ret []dueRecord) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for domain, types := range d.data {
+		for typ, record := range types {
+			if record.expired(now) {
+				continue
+			}
+			if record.published && now.Sub(record.replicated) >= republishInterval {
+				ttl := expireInterval
+				if !record.expires.IsZero() {
+					ttl = record.expires.Sub(now)
+				}
+				ret = append(ret, dueRecord{domain, typ, record.set, ttl, true})
+			} else if !record.published && now.Sub(record.replicated) >= replicateInterval {
+				ret = append(ret, dueRecord{domain, typ, record.set, record.expires.Sub(now), false})
+			} else {
+				continue
+			}
+			record.replicated = now
+			if err := d.save(domain, typ, record); err != nil {
+				log.Printf("Error saving %s records for %s: %s\n", typ, domain, err)
+			}
+		}
 	}
 	return
 }
@@ -1,19 +1,32 @@
 package kademlia
 
 import (
+	"crypto/ed25519"
 	"net"
 	"testing"
+	"time"
 )
 
+// onlyIP returns the address in a set of exactly one record, or nil.
+func onlyIP(records []Record) net.IP {
+	if len(records) != 1 {
+		return nil
+	}
+	return records[0].IP
+}
+
 func TestStoreRecord(t *testing.T) {
 	d := NewDomainStore()
 	domain := "www.google.com"
 	typ := "A"
 	ip := net.ParseIP("74.125.224.72")
-	d.storeRecord(domain, typ, ip)
+	d.storeRecord(domain, typ, signed(domain, typ, Record{IP: ip, TTL: DefaultTTL}), time.Hour)
 
-	if !d.data[domain][typ].Equal(ip) {
-		t.Errorf("Data record %s does not match what was saved (%s)!", d.data[domain][typ].String(), ip.String())
+	if stored := d.data[domain][typ].set.Records; !onlyIP(stored).Equal(ip) {
+		t.Errorf("Data record %v does not match what was saved (%s)!", stored, ip.String())
+	}
+	if d.data[domain][typ].published {
+		t.Errorf("Stored replica should not be marked as published")
 	}
 }
 
@@ -22,11 +35,266 @@ func TestRetrieve(t *testing.T) {
 	domain := "www.google.com"
 	typ := "A"
 	ip := net.ParseIP("74.125.224.72")
-	d.data[domain] = make(map[string]net.IP)
-	d.data[domain][typ] = ip
+	d.data[domain] = make(map[string]*domainRecord)
+	d.data[domain][typ] = &domainRecord{signed(domain, typ, Record{IP: ip, TTL: DefaultTTL}), time.Now().Add(time.Hour), time.Now(), false}
+
+	ret := d.retrieve(domain, typ).Records
+	if !onlyIP(ret).Equal(ip) {
+		t.Errorf("Data record %v does not match what was saved (%s)!", ret, ip.String())
+	}
+
+	d.data[domain][typ].expires = time.Now()
+	if ret = d.retrieve(domain, typ).Records; ret != nil {
+		t.Errorf("Expired data record %v should not be retrieved!", ret)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	d := NewDomainStore()
+	ip := net.ParseIP("74.125.224.72")
+	d.storeRecord("www.google.com", "A", signed("www.google.com", "A", Record{IP: ip, TTL: DefaultTTL}), time.Hour)
+	d.storeRecord("www.facebook.com", "A", signed("www.facebook.com", "A", Record{IP: ip, TTL: DefaultTTL}), 0)
+	d.publishRecord("example.com", "A", signed("example.com", "A", Record{IP: ip, TTL: DefaultTTL}))
+
+	d.expire(time.Now().Add(2 * time.Hour))
+	if d.data["www.google.com"] != nil {
+		t.Errorf("Expected www.google.com to expire after its one hour TTL")
+	}
+	if d.retrieve("www.facebook.com", "A").Records == nil {
+		t.Errorf("Expected www.facebook.com to live for the default expiry")
+	}
+
+	d.expire(time.Now().Add(expireInterval))
+	if d.retrieve("www.facebook.com", "A").Records != nil {
+		t.Errorf("Expected www.facebook.com to expire after %s", expireInterval)
+	}
+	if d.retrieve("example.com", "A").Records == nil {
+		t.Errorf("Expected published record example.com to never expire locally")
+	}
+}
+
+func TestDue(t *testing.T) {
+	d := NewDomainStore()
+	ip := net.ParseIP("74.125.224.72")
+	d.storeRecord("www.google.com", "A", signed("www.google.com", "A", Record{IP: ip, TTL: DefaultTTL}), 0)
+	own := signed("example.com", "A", Record{IP: ip, TTL: DefaultTTL})
+	d.publishRecord("example.com", "A", own)
+
+	now := time.Now()
+	if due := d.due(now); len(due) != 0 {
+		t.Errorf("Expected nothing due right after storing, found %d records", len(due))
+	}
+
+	due := d.due(now.Add(replicateInterval))
+	if len(due) != 1 || due[0].domain != "www.google.com" {
+		t.Fatalf("Expected only the replica to be due hourly, found %v", due)
+	}
+	if due[0].ttl > expireInterval-replicateInterval+time.Second {
+		t.Errorf("Expected replica to be sent with its remaining TTL, found %s", due[0].ttl)
+	}
+	if due = d.due(now.Add(replicateInterval)); len(due) != 0 {
+		t.Errorf("Expected record not to be due again until the next interval, found %d", len(due))
+	}
+
+	due = d.due(now.Add(republishInterval))
+	if len(due) != 2 {
+		t.Errorf("Expected both records due after a day, found %d", len(due))
+	}
+
+	// A replica of our own record does not take away our ownership, nor
+	// put off our own republishing
+	republished := d.data["example.com"]["A"].replicated
+	d.storeRecord("example.com", "A", own, time.Hour)
+	if !d.data["example.com"]["A"].published {
+		t.Errorf("Expected example.com to remain published")
+	}
+	if replicated := d.data["example.com"]["A"].replicated; !replicated.Equal(republished) {
+		t.Errorf("Expected republish timer to stay at %s, found %s", republished, replicated)
+	}
+}
+
+func TestRetrieveNormalized(t *testing.T) {
+	d := NewDomainStore()
+	ip := net.ParseIP("74.125.224.72")
+	d.storeRecord("WWW.Google.com.", "a", signed("WWW.Google.com.", "a", Record{IP: ip, TTL: DefaultTTL}), time.Hour)
+
+	if ret := d.retrieve("www.google.com", "A").Records; !onlyIP(ret).Equal(ip) {
+		t.Errorf("Expected %s for normalized name, received %v", ip, ret)
+	}
+}
+
+func TestStoreRecordSet(t *testing.T) {
+	d := NewDomainStore()
+	set := []Record{
+		{IP: net.ParseIP("74.125.224.72"), TTL: time.Minute},
+		{IP: net.ParseIP("74.125.224.73"), TTL: time.Hour},
+	}
+	d.storeRecord("www.google.com", "A", signed("www.google.com", "A", set...), time.Hour)
+
+	if ret := d.retrieve("www.google.com", "A").Records; !sameRecords(ret, set) {
+		t.Errorf("Expected record set %v, received %v", set, ret)
+	}
+
+	// A newly stored set replaces the old one rather than adding to it
+	replacement := []Record{{IP: net.ParseIP("74.125.224.74"), TTL: time.Minute}}
+	d.storeRecord("www.google.com", "A", signed("www.google.com", "A", replacement...), time.Hour)
+	if ret := d.retrieve("www.google.com", "A").Records; !sameRecords(ret, replacement) {
+		t.Errorf("Expected replaced record set %v, received %v", replacement, ret)
+	}
+}
+
+func TestStoreRecordOwner(t *testing.T) {
+	d := NewDomainStore()
+	claim := NewRegistration(testKey, "www.google.com", 1, time.Now(), time.Now().Add(time.Hour), testDifficulty)
+	if err := d.storeRecord("www.google.com", RegistrationType, claim, time.Hour); err != nil {
+		t.Fatalf("Error storing registration: %s", err)
+	}
+
+	// Only the owner may replace a registration with a later claim
+	_, other, _ := ed25519.GenerateKey(nil)
+	hijack := NewRegistration(other, "www.google.com", nextSequence(0), time.Now(), time.Now().Add(3*time.Hour), testDifficulty)
+	if err := d.storeRecord("www.google.com", RegistrationType, hijack, time.Hour); err != ErrNotOwner {
+		t.Errorf("Expected ErrNotOwner storing another key's registration, received %v", err)
+	}
+	if err := d.publishRecord("www.google.com", RegistrationType, hijack); err != ErrNotOwner {
+		t.Errorf("Expected ErrNotOwner publishing another key's registration, received %v", err)
+	}
+	if ret := d.retrieve("www.google.com", RegistrationType); !ret.Owner.Equal(testKey.Public()) {
+		t.Errorf("Expected owner's registration to remain, received %v", ret)
+	}
+
+	// Other sets are checked against the registration before they are stored,
+	// so a new owner's records replace those of the last, whatever their version
+	ip := net.ParseIP("74.125.224.72")
+	if err := d.storeRecord("www.google.com", "A", signed("www.google.com", "A", Record{IP: ip, TTL: DefaultTTL}), time.Hour); err != nil {
+		t.Fatalf("Error storing signed record: %s", err)
+	}
+	unsigned := signed("www.google.com", "A", Record{IP: net.ParseIP("10.0.0.1"), TTL: DefaultTTL})
+	unsigned.Signature = nil
+	if err := d.storeRecord("www.google.com", "A", unsigned, time.Hour); err != ErrBadSignature {
+		t.Errorf("Expected ErrBadSignature storing unsigned records, received %v", err)
+	}
+	if ret := d.retrieve("www.google.com", "A").Records; !onlyIP(ret).Equal(ip) {
+		t.Errorf("Expected owner's record %s to remain, received %v", ip, ret)
+	}
+	moved := SignRecords(other, "www.google.com", "A", 1, []Record{{IP: net.ParseIP("10.0.0.1"), TTL: DefaultTTL}})
+	if err := d.storeRecord("www.google.com", "A", moved, time.Hour); err != nil {
+		t.Errorf("Expected a new owner's records to be stored, received %s", err)
+	}
+
+	// Once the owner's registration expires the name is free again
+	d.expire(time.Now().Add(2 * time.Hour))
+	if err := d.storeRecord("www.google.com", RegistrationType, hijack, time.Hour); err != nil {
+		t.Errorf("Expected expired name to be free, received %s", err)
+	}
+}
+
+func TestStoreRegistrationOrder(t *testing.T) {
+	now := time.Now()
+	_, other, _ := ed25519.GenerateKey(nil)
+	first := NewRegistration(other, "example.com", 2, now, now.Add(time.Hour), testDifficulty)
+	second := NewRegistration(testKey, "example.com", 1, now.Add(-time.Hour), now.Add(time.Hour), testDifficulty)
+	current := NewRegistration(testKey, "example.com", 1, now, now.Add(time.Hour), testDifficulty)
+	renewal := NewRegistration(testKey, "example.com", 3, now.Add(-time.Hour), now.Add(2*time.Hour), testDifficulty)
+
+	// Between owners the first claim a replica sees wins, however early the
+	// other says it was made
+	d := NewDomainStore()
+	if err := d.storeRecord("example.com", RegistrationType, first, time.Hour); err != nil {
+		t.Fatalf("Error storing registration: %s", err)
+	}
+	if err := d.storeRecord("example.com", RegistrationType, second, time.Hour); err != ErrNotOwner {
+		t.Errorf("Expected ErrNotOwner storing a backdated claim, received %v", err)
+	}
+	if ret := d.retrieve("example.com", RegistrationType); !ret.Owner.Equal(other.Public()) {
+		t.Errorf("Expected the first claim to be held, received %v", ret)
+	}
+
+	// A new claim must have been signed just now, even on an unclaimed name
+	d = NewDomainStore()
+	if err := d.storeRecord("example.com", RegistrationType, second, time.Hour); err == nil {
+		t.Errorf("Expected a backdated claim to be refused")
+	}
+	if err := d.publishRecord("example.com", RegistrationType, second); err == nil {
+		t.Errorf("Expected a backdated claim to be refused for publishing")
+	}
+
+	// Between versions from the same owner the newest wins, however long
+	// ago it was signed
+	if err := d.storeRecord("example.com", RegistrationType, current, time.Hour); err != nil {
+		t.Fatalf("Error storing registration: %s", err)
+	}
+	if err := d.storeRecord("example.com", RegistrationType, renewal, time.Hour); err != nil {
+		t.Errorf("Expected a newer version of a held claim to be stored, received %s", err)
+	}
+	if err := d.storeRecord("example.com", RegistrationType, current, time.Hour); err != ErrStaleRecord {
+		t.Errorf("Expected ErrStaleRecord storing an older version of a claim, received %v", err)
+	}
+	if ret := d.retrieve("example.com", RegistrationType); ret.Sequence != renewal.Sequence {
+		t.Errorf("Expected the renewed claim to be held, found version %d", ret.Sequence)
+	}
+}
+
+func TestStoreRecordSequence(t *testing.T) {
+	d := NewDomainStore()
+	older := signed("www.google.com", "A", Record{IP: net.ParseIP("74.125.224.72"), TTL: DefaultTTL})
+	newer := signed("www.google.com", "A", Record{IP: net.ParseIP("74.125.224.73"), TTL: DefaultTTL})
+	if err := d.storeRecord("www.google.com", "A", newer, time.Hour); err != nil {
+		t.Fatalf("Error storing record set: %s", err)
+	}
+	if err := d.storeRecord("www.google.com", "A", older, time.Hour); err != ErrStaleRecord {
+		t.Errorf("Expected ErrStaleRecord storing an older version, received %v", err)
+	}
+	if err := d.publishRecord("www.google.com", "A", older); err != ErrStaleRecord {
+		t.Errorf("Expected ErrStaleRecord publishing an older version, received %v", err)
+	}
+	if err := d.storeRecord("www.google.com", "A", newer, time.Hour); err != nil {
+		t.Errorf("Expected the same version to be stored again, received %s", err)
+	}
+	if ret := d.retrieve("www.google.com", "A"); ret.Sequence != newer.Sequence {
+		t.Errorf("Expected version %d to remain, found %d", newer.Sequence, ret.Sequence)
+	}
+
+	// Sets with the same sequence number settle on the same one in any order
+	a := SignRecords(testKey, "example.com", "A", 1, []Record{{IP: net.ParseIP("10.0.0.1"), TTL: DefaultTTL}})
+	b := SignRecords(testKey, "example.com", "A", 1, []Record{{IP: net.ParseIP("10.0.0.2"), TTL: DefaultTTL}})
+	first, second := NewDomainStore(), NewDomainStore()
+	first.storeRecord("example.com", "A", a, time.Hour)
+	first.storeRecord("example.com", "A", b, time.Hour)
+	second.storeRecord("example.com", "A", b, time.Hour)
+	second.storeRecord("example.com", "A", a, time.Hour)
+	if x, y := first.retrieve("example.com", "A"), second.retrieve("example.com", "A"); !sameRecords(x.Records, y.Records) {
+		t.Errorf("Expected replicas to agree on conflicting sets, found %v and %v", x.Records, y.Records)
+	}
+}
+
+func TestStoreTombstone(t *testing.T) {
+	d := NewDomainStore()
+	older := signed("www.google.com", "A", Record{IP: net.ParseIP("74.125.224.72"), TTL: DefaultTTL})
+	tombstone := SignTombstone(testKey, "www.google.com", "A", nextSequence(older.Sequence))
+	d.storeRecord("www.google.com", "A", older, expireInterval)
+	if err := d.storeRecord("www.google.com", "A", tombstone, tombstoneGracePeriod); err != nil {
+		t.Fatalf("Error storing tombstone: %s", err)
+	}
+	if ret := d.retrieve("www.google.com", "A"); !ret.Deleted || ret.Records != nil {
+		t.Errorf("Expected tombstone to replace the records, found %v", ret)
+	}
+	if err := d.storeRecord("www.google.com", "A", older, expireInterval); err != ErrStaleRecord {
+		t.Errorf("Expected ErrStaleRecord storing records the tombstone deleted, received %v", err)
+	}
 
-	ret := d.retrieve(domain, typ)
-	if !ret.Equal(ip) {
-		t.Errorf("Data record %s does not match what was saved (%s)!", ret.String(), ip.String())
+	// Tombstones outlive any replica of the records they delete, but are
+	// dropped after their grace period, even when published
+	d.publishRecord("example.com", "A", SignTombstone(testKey, "example.com", "A", nextSequence(0)))
+	d.expire(time.Now().Add(expireInterval))
+	if ret := d.retrieve("www.google.com", "A"); !ret.Deleted {
+		t.Errorf("Expected stored tombstone to outlive the records, found %v", ret)
+	}
+	d.expire(time.Now().Add(tombstoneGracePeriod))
+	if ret := d.retrieve("www.google.com", "A"); !ret.empty() {
+		t.Errorf("Expected stored tombstone to be collected, found %v", ret)
+	}
+	if ret := d.retrieve("example.com", "A"); !ret.empty() {
+		t.Errorf("Expected published tombstone to be collected, found %v", ret)
 	}
 }
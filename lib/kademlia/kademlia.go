@@ -1,308 +1,912 @@
 package kademlia
 
 import (
-	"container/heap"
-	"container/list"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
 	"fmt"
+	"hash"
 	"log"
-	"net"
-	"net/http"
-	"net/rpc"
-	"sort"
+	"sync"
+	"time"
 )
 
 // Core kademlia structs
 
+// alpha is the number of concurrent queries sent during iterative lookups
+const alpha = 3
+
+// replicaQuorum is how many replicas a lookup hears from before settling on
+// the newest version of a record set
+const replicaQuorum = 3
+
+// Defaults for how long a node waits on the network
+const (
+	rpcTimeout    = 5 * time.Second  // for a reply to a single RPC
+	rpcRetries    = 1                // resends of an RPC that went unanswered
+	lookupTimeout = 30 * time.Second // for an iterative lookup as a whole
+)
+
+// maintenanceInterval is how often a node checks its records for expiry and republishing
+const maintenanceInterval = time.Minute
+
+// refreshInterval is the default time a bucket may go without a lookup before it is refreshed
+const refreshInterval = time.Hour
+
+// nonceSize is the length of the nonce a caller puts in each RPC header
+const nonceSize = 16
+
 // Kademlia type for handling the DHT node
 type Kademlia struct {
 	routes    *RoutingTable
+	key       ed25519.PrivateKey // the key the node's id is derived from
 	NetworkID string
 	domains   *DomainStore
+	mutex     sync.Mutex // guards done
+	done      chan struct{}
+	running   sync.WaitGroup // counts maintain while it runs
+	evicting  sync.Map       // ids of contacts being pinged to make room in their bucket
+
+	// Transport carries the node's RPCs.  It defaults to an RPCTransport;
+	// set it before calling Join.
+	Transport Transport
+
+	// RoutesFile, if set, is where the routing table is saved every
+	// maintenance interval and when the node is closed, to be restored with
+	// LoadRoutes and Rejoin.  Set it before calling Join.
+	RoutesFile string
+
+	// Backend saves the node's records across restarts.  It defaults to a
+	// memory backend that saves nothing; set it before calling Join, which
+	// loads the records it holds.
+	Backend Backend
+
+	// RefreshInterval is how long a bucket may go without a lookup before the
+	// node refreshes it with a lookup of its own.  Set it before calling Join.
+	RefreshInterval time.Duration
+
+	// KeyHash derives DHT keys from domain records and must match across the
+	// network.  It defaults to SHA-1; set it before calling Join.
+	KeyHash func() hash.Hash
+
+	// RPCTimeout is how long the node waits for a reply to an RPC before
+	// trying again, up to RPCRetries more times, and LookupTimeout bounds
+	// each iterative lookup as a whole.  Set them before calling Join.
+	RPCTimeout    time.Duration
+	RPCRetries    int
+	LookupTimeout time.Duration
+
+	// DisjointPaths is how many disjoint paths each lookup takes through the
+	// network, as in S/Kademlia.  The closest nodes known are dealt out among
+	// the paths and no node is queried on more than one, so a hostile node
+	// can only lead astray the path it is on, at the cost of more queries
+	// and of the nodes found being only roughly the closest.  It defaults to
+	// 1, a plain Kademlia lookup; set it before calling Join.
+	DisjointPaths int
+
+	// Difficulty is the number of leading zero bits the proof-of-work on a
+	// registration needs, and must match across the network.  It defaults to
+	// DefaultDifficulty; set it before calling Join.
+	Difficulty int
+
+	// NodeDifficulty is the number of leading zero bits the static puzzle
+	// on node ids needs, and must match across the network.  Contacts whose
+	// ids fall short are ignored.  It defaults to DefaultNodeDifficulty; set
+	// it before calling Join.
+	NodeDifficulty int
 }
 
 type kademliaCore struct {
 	kad *Kademlia
 }
 
-// RPC Request and Response structs
+// ErrNotFound is returned by Get when no node in the network holds the record.
+var ErrNotFound = errors.New("Record not found")
+
+// ErrNotStored is returned when too few of the nodes closest to a record
+// set's key accept it.
+var ErrNotStored = errors.New("Record set was not accepted by enough nodes")
 
-// RPCHeader type for storing sender information and network ID
+// RPC Request and Response structs
+//
+// These are exported so that a Transport can carry them between nodes; they
+// are not meant to be built outside the package.
+
+// RPCHeader type for storing sender information and network ID.  The sender
+// signs the header with the key its id is derived from, over a nonce chosen
+// by the caller and repeated in the reply, so a reply cannot be replayed.
+// The signature covers the header alone, not the rest of the message: it
+// proves who sent a message, but not that its body is what the sender wrote,
+// so the contacts in a reply can be altered in transit.  Record sets are
+// signed by their owners for that reason.
 type RPCHeader struct {
 	Sender    *Contact
 	NetworkID string
+	Nonce     []byte
+	Signature []byte
+}
+
+func (header *RPCHeader) header() *RPCHeader {
+	return header
 }
 
-type pingRequest struct {
+// signedData encodes the header unambiguously, as the message its sender
+// signs.
+func (header *RPCHeader) signedData() []byte {
+	data := []byte("dominion rpc\x00")
+	data = appendField(data, []byte(header.NetworkID))
+	data = appendField(data, header.Nonce)
+	data = appendField(data, header.Sender.id[:])
+	data = appendField(data, header.Sender.key)
+	return appendField(data, []byte(header.Sender.address))
+}
+
+// PingRequest - RPC arguments for kademliaCore.Ping
+type PingRequest struct {
 	RPCHeader
 }
 
-type pingResponse struct {
+// PingResponse - RPC reply for kademliaCore.Ping
+type PingResponse struct {
 	RPCHeader
 }
 
-type storeRequest struct {
+// StoreRequest - RPC arguments for kademliaCore.Store
+type StoreRequest struct {
 	RPCHeader
-	domain string
-	typ    string
-	ip     net.IP
+	Domain string
+	Type   string
+	RecordSet
+	TTL          time.Duration // how long the receiver keeps the records
+	Registration *RecordSet    // the domain's registration, for sets of any other type
 }
 
-type storeResponse struct {
+// StoreResponse - RPC reply for kademliaCore.Store
+type StoreResponse struct {
 	RPCHeader
 }
 
-type findNodeRequest struct {
+// FindNodeRequest - RPC arguments for kademliaCore.FindNode
+type FindNodeRequest struct {
 	RPCHeader
-	target NodeID
+	Target NodeID
 }
 
-type findNodeResponse struct {
+// FindNodeResponse - RPC reply for kademliaCore.FindNode
+type FindNodeResponse struct {
 	RPCHeader
-	contacts []Contact
+	Contacts []Contact
 }
 
-type findValueRequest struct {
+// FindValueRequest - RPC arguments for kademliaCore.FindValue
+type FindValueRequest struct {
 	RPCHeader
-	domain string
-	typ    string
+	Domain string
+	Type   string
 }
 
-type findValueResponse struct {
+// FindValueResponse - RPC reply for kademliaCore.FindValue
+type FindValueResponse struct {
 	RPCHeader
-	ip       net.IP
-	contacts []Contact
+	RecordSet
+	Contacts []Contact
 }
 
 // Data structures for internal use
 
-// ContactHeap
-type contactHeap []Contact
+// ContactRecList
+type contactRecList []*ContactRecord
 
-func (c contactHeap) Len() int           { return len(c) }
-func (c contactHeap) Less(i, j int) bool { return c[i].Less(&c[j]) }
-func (c contactHeap) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (cr contactRecList) Len() int           { return len(cr) }
+func (cr contactRecList) Less(i, j int) bool { return cr[i].Less(cr[j]) }
+func (cr contactRecList) Swap(i, j int)      { cr[i], cr[j] = cr[j], cr[i] }
 
-func (c *contactHeap) Push(x interface{}) {
-	*c = append(*c, x.(Contact))
+func (cr *contactRecList) Push(x interface{}) {
+	*cr = append(*cr, x.(*ContactRecord))
 }
 
-func (c *contactHeap) Pop() interface{} {
-	old := *c
+func (cr *contactRecList) Pop() interface{} {
+	old := *cr
 	n := len(old)
 	x := old[n-1]
-	*c = old[0 : n-1]
+	*cr = old[0 : n-1]
 	return x
 }
 
-// ContactRecList
-type contactRecList []*ContactRecord
-
-func (cr contactRecList) Len() int           { return len(cr) }
-func (cr contactRecList) Less(i, j int) bool { return cr[i].Less(cr[j]) }
-func (cr contactRecList) Swap(i, j int)      { cr[i], cr[j] = cr[j], cr[i] }
-
 // kademlia functionality
 
-// NewKademlia - create new Kademlia node
-func NewKademlia(self *Contact, networkID string) (ret *Kademlia) {
+// NewKademlia - create new Kademlia node reachable at address, whose id is
+// derived from key.  The key should come from NewNodeKey or LoadNodeKey.
+func NewKademlia(key ed25519.PrivateKey, address string, networkID string) (ret *Kademlia) {
 	ret = new(Kademlia)
-	ret.routes = NewRoutingTable(self)
+	self := newKeyedContact(key.Public().(ed25519.PublicKey), address)
+	ret.routes = NewRoutingTable(&self)
+	ret.key = key
 	ret.NetworkID = networkID
 	ret.domains = NewDomainStore()
+	ret.RefreshInterval = refreshInterval
+	ret.KeyHash = sha1.New
+	ret.Difficulty = DefaultDifficulty
+	ret.NodeDifficulty = DefaultNodeDifficulty
+	ret.RPCTimeout = rpcTimeout
+	ret.RPCRetries = rpcRetries
+	ret.LookupTimeout = lookupTimeout
+	ret.DisjointPaths = 1
+	ret.Transport = NewRPCTransport()
+	ret.Backend = NewMemoryBackend()
 	return
 }
 
-func (k *Kademlia) update(contact *Contact, table *RoutingTable) {
-	prefixLength := contact.id.Xor(table.node.id).PrefixLen()
-	bucket := table.buckets[prefixLength]
-	var elt *list.Element
-	for elt = bucket.Front(); elt != nil; elt = elt.Next() {
-		if elt.Value.(*Contact).id.Equals(contact.id) {
-			break
-		} else if elt.Value.(*Contact).id.Equals(table.node.id) {
-			return
-		}
+// domainKey returns the DHT key a domain record is stored under.
+func (k *Kademlia) domainKey(domain string, typ string) NodeID {
+	return HashDomainKey(k.KeyHash, domain, typ)
+}
+
+// Join starts serving RPCs for the node and enters the network through the
+// bootstrap contacts.  A bootstrap contact's id may be left zero when only
+// its address is known.  Calling Join with no contacts starts a new network.
+// The node keeps serving after ctx is done; only entering the network stops.
+func (k *Kademlia) Join(ctx context.Context, bootstrap ...Contact) (err error) {
+	if err = k.serve(); err != nil || len(bootstrap) == 0 {
+		return
 	}
-	if elt == nil {
-		if bucket.Len() <= bucketSize {
-			bucket.PushFront(contact)
+
+	alive := 0
+	for i := range bootstrap {
+		if err := k.sendPingQuery(ctx, &bootstrap[i]); err == nil {
+			alive++
 		} else {
-			// ping last seen node and handle for alive/dead
-			last := bucket.Back().Value.(*Contact)
-			if err := k.sendPingQuery(last); err == nil {
-				/* TODO: Add new element to replacement cache list */
-			} else {
-				// Replace dead node with new live one
-				bucket.Remove(bucket.Back())
-				bucket.PushFront(contact)
-			}
+			log.Printf("Error pinging bootstrap contact %s: %s\n", bootstrap[i].address, err)
 		}
-	} else {
-		bucket.MoveToFront(elt)
 	}
+	if alive == 0 {
+		return fmt.Errorf("Unable to reach any of %d bootstrap contacts", len(bootstrap))
+	}
+	k.populate(ctx)
+	return
 }
 
-func (k *Kademlia) serve() (err error) {
-	rpc.Register(&kademliaCore{k})
+// populate looks the node itself up to fill the buckets near its id, then
+// refreshes every bucket further away than its closest neighbor.
+func (k *Kademlia) populate(ctx context.Context) {
+	k.iterativeFindNode(ctx, k.routes.node.id, alpha)
+	for i := 0; i < k.routes.closestBucket() && ctx.Err() == nil; i++ {
+		k.iterativeFindNode(ctx, k.routes.randomIDInBucket(i), alpha)
+	}
+}
 
-	rpc.HandleHTTP()
-	if l, err := net.Listen("tcp", k.routes.node.address); err == nil {
-		go http.Serve(l, nil)
+// Register claims a domain for owner for the given lifetime, doing the
+// proof-of-work the network requires, and stores the registration locally and
+// on the closest nodes in the network.  The first valid claim on a domain
+// wins: registering a domain that another key holds an unexpired claim on
+// fails with ErrNotOwner.  Owners renew their claims by registering again,
+// which replicas already holding the claim accept as a newer version and
+// nodes that have since become the closest take as a new one.  If too few of
+// the closest nodes accept the registration it fails with ErrNotStored,
+// though the node still holds and republishes its own copy.
+func (k *Kademlia) Register(ctx context.Context, owner ed25519.PrivateKey, domain string, lifetime time.Duration) (err error) {
+	if domain == "" || lifetime <= 0 || lifetime > MaxRegistrationLifetime {
+		return fmt.Errorf("Invalid registration of domain %q for %s", domain, lifetime)
 	}
-	return
+	if current, err := k.Registration(ctx, domain); err == nil && !current.Owner.Equal(owner.Public()) {
+		return ErrNotOwner
+	}
+
+	sequence := nextSequence(k.domains.retrieve(domain, RegistrationType).Sequence)
+	set := NewRegistration(owner, domain, sequence, time.Now(), time.Now().Add(lifetime), k.Difficulty)
+	if err = k.domains.publishRecord(domain, RegistrationType, set); err != nil {
+		return
+	}
+	return k.iterativeStore(ctx, domain, RegistrationType, set, nil, expireInterval)
 }
 
-func (k *Kademlia) call(contact *Contact, method string, args, reply interface{}) (err error) {
-	if client, err := rpc.DialHTTP("tcp", contact.address); err == nil {
-		err = client.Call(method, args, reply)
-		if err == nil {
-			k.update(contact, k.routes)
-		}
+// Registration looks up the unexpired registration for a domain, the claim on
+// it that most of its replicas hold, failing with ErrNotRegistered if there
+// is none.
+func (k *Kademlia) Registration(ctx context.Context, domain string) (set RecordSet, err error) {
+	set, _ = k.iterativeFindValue(ctx, domain, RegistrationType, alpha, nil)
+	if set.Records == nil {
+		err = ErrNotRegistered
 	}
 	return
 }
 
-func (k *Kademlia) sendPingQuery(node *Contact) (err error) {
-	args := pingRequest{RPCHeader{&k.routes.node, k.NetworkID}}
-	reply := pingResponse{}
+// heldRegistration returns the registration for a domain this node holds if
+// it is still valid, looking it up in the network otherwise.
+func (k *Kademlia) heldRegistration(ctx context.Context, domain string) (RecordSet, error) {
+	held := k.domains.retrieve(domain, RegistrationType)
+	if checkRegistration(domain, &held, k.Difficulty, time.Now()) == nil {
+		return held, nil
+	}
+	return k.Registration(ctx, domain)
+}
 
-	err = k.call(node, "kademliaCore.ping", &args, &reply)
-	return
+// checkOwner checks that a record set for a domain is signed by the owner of
+// the registration sent with it, which must be valid and from the same owner
+// as any unexpired registration this node holds for the domain.  The check
+// never goes to the network, so a store is answered well within the sender's
+// deadline.
+func (k *Kademlia) checkOwner(domain string, set *RecordSet, registration *RecordSet) error {
+	if registration == nil {
+		return ErrNotRegistered
+	}
+	now := time.Now()
+	if err := checkRegistration(domain, registration, k.Difficulty, now); err != nil {
+		return err
+	}
+	held := k.domains.retrieve(domain, RegistrationType)
+	if checkRegistration(domain, &held, k.Difficulty, now) == nil && !held.Owner.Equal(registration.Owner) {
+		return ErrNotOwner
+	}
+	if !set.Owner.Equal(registration.Owner) {
+		return ErrNotOwner
+	}
+	return nil
 }
 
-func (k *Kademlia) sendFindNodeQuery(node *Contact, target NodeID, done chan []Contact) {
-	args := findNodeRequest{RPCHeader{&k.routes.node, k.NetworkID}, target}
-	reply := findNodeResponse{}
+// Put signs a new version of the record set for a domain and type with the
+// owner's key and stores it locally and on the closest nodes in the network,
+// replacing any set stored before.  The domain must be registered to owner.
+// Records without a TTL are given DefaultTTL.  As with Register, it fails with
+// ErrNotStored if too few of the closest nodes accept the set.
+func (k *Kademlia) Put(ctx context.Context, owner ed25519.PrivateKey, domain string, typ string, records ...Record) (err error) {
+	if domain == "" || normalizeType(typ) == RegistrationType {
+		return fmt.Errorf("Invalid %s record set for domain %q", typ, domain)
+	}
+	registration, err := k.Registration(ctx, domain)
+	if err != nil {
+		return
+	}
+	if !registration.Owner.Equal(owner.Public()) {
+		return ErrNotOwner
+	}
+	signed := make([]Record, len(records))
+	for i, record := range records {
+		if record.TTL == 0 {
+			record.TTL = DefaultTTL
+		}
+		signed[i] = record
+	}
+	if err = validateRecords(typ, signed); err != nil {
+		return
+	}
+	set := SignRecords(owner, domain, typ, nextSequence(k.domains.retrieve(domain, typ).Sequence), signed)
+	if err = k.domains.publishRecord(domain, typ, set); err != nil {
+		return
+	}
+	return k.iterativeStore(ctx, domain, typ, set, &registration, expireInterval)
+}
 
-	if err := k.call(node, "kademliaCore.findNode", &args, &reply); err == nil {
-		done <- reply.contacts
-	} else {
-		done <- []Contact{}
+// Delete replaces the record sets for a domain with tombstones signed by the
+// owner's key, which supersede the sets on every replica they reach.  The
+// publishers of the sets look for a newer version before each daily
+// republish and drop their own copy when they find the tombstone, so the
+// tombstones are forgotten after tombstoneGracePeriod, once every other
+// replica of the sets has expired.  The domain must be
+// registered to owner.  With no types given, every type of set the domain has
+// is deleted; the registration itself is kept.  It stops with ErrNotStored at
+// the first tombstone too few of the closest nodes accept.
+func (k *Kademlia) Delete(ctx context.Context, owner ed25519.PrivateKey, domain string, types ...string) (err error) {
+	registration, err := k.Registration(ctx, domain)
+	if err != nil {
+		return
+	}
+	if !registration.Owner.Equal(owner.Public()) {
+		return ErrNotOwner
+	}
+	all := len(types) == 0
+	if all {
+		types = recordTypes
+	}
+	for _, typ := range types {
+		if !deletable(typ) {
+			return fmt.Errorf("Invalid %s tombstone for domain %q", typ, domain)
+		}
+		// The tombstone must supersede the newest version anywhere
+		current, _ := k.iterativeFindValue(ctx, domain, typ, alpha, &registration)
+		if all && (current.empty() || current.Deleted) {
+			continue
+		}
+		set := SignTombstone(owner, domain, typ, nextSequence(current.Sequence))
+		if err = k.domains.publishRecord(domain, typ, set); err != nil {
+			return
+		}
+		if err = k.iterativeStore(ctx, domain, typ, set, &registration, tombstoneGracePeriod); err != nil {
+			return
+		}
 	}
+	return
+}
+
+// Get looks up the record set for a domain and type, returning ErrNotFound if
+// the domain is not registered, the set was deleted or no node has a set
+// signed by its registered owner.
+func (k *Kademlia) Get(ctx context.Context, domain string, typ string) (records []Record, err error) {
+	registration, err := k.Registration(ctx, domain)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	set, _ := k.iterativeFindValue(ctx, domain, typ, alpha, &registration)
+	if records = set.Records; len(records) == 0 {
+		err = ErrNotFound
+	}
+	return
+}
+
+// Self returns the contact the node gives out for itself.
+func (k *Kademlia) Self() Contact {
+	return k.routes.node
 }
 
-func (k *Kademlia) sendstoreQuery(node *Contact, domain string, typ string, ip net.IP) (err error) {
-	args := storeRequest{RPCHeader{&k.routes.node, k.NetworkID}, domain, typ, ip}
-	reply := storeResponse{}
+// Stats reports the number of contacts and cached replacements in each bucket
+// of the node's routing table.
+func (k *Kademlia) Stats() RoutingStats {
+	return k.routes.stats()
+}
 
-	err = k.call(node, "kademliaCore.store", &args, &reply)
+// Close stops the node from serving RPCs and maintaining its records, and
+// closes its Transport and Backend.
+func (k *Kademlia) Close() (err error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.done != nil {
+		close(k.done)
+		k.done = nil
+		// Maintenance saves the routes too, so let it finish first
+		k.running.Wait()
+		k.saveRoutes()
+	}
+	err = k.Transport.Close()
+	k.domains.mutex.Lock()
+	defer k.domains.mutex.Unlock()
+	if berr := k.domains.backend.Close(); err == nil {
+		err = berr
+	}
 	return
 }
 
-func (k *Kademlia) iterativeFindNode(target NodeID, delta int) (ret contactRecList) {
-	done := make(chan []Contact)
+// update records that a contact was seen.  If its bucket is full the
+// newcomer is held in reserve while the least recently seen contact is pinged
+// in the background, so that no RPC waits on the ping; call drops the contact
+// if it fails to answer, promoting the newcomer in its place.
+func (k *Kademlia) update(contact *Contact, table *RoutingTable) {
+	if contact.id.Equals(table.node.id) {
+		return
+	}
+	last := table.insert(contact)
+	if last == nil {
+		return
+	}
+	table.addReplacement(contact)
+	if _, pinging := k.evicting.LoadOrStore(last.id, true); pinging {
+		return
+	}
+	go func() {
+		defer k.evicting.Delete(last.id)
+		// Long enough for every attempt call makes, so that a contact that
+		// never answers is still dropped
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(k.RPCRetries+2)*k.RPCTimeout)
+		defer cancel()
+		k.sendPingQuery(ctx, last)
+	}()
+}
+
+func (k *Kademlia) serve() (err error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.done != nil {
+		return
+	}
 
-	// A heap of not-yet-queried *Contact structs
-	frontier := &contactHeap{}
-	heap.Init(frontier)
+	// Other nodes would ignore us
+	if err = verifyContact(&k.routes.node, k.NodeDifficulty); err != nil {
+		return
+	}
+	if err = k.domains.open(k.Backend); err != nil {
+		return
+	}
+	if err = k.Transport.Listen(k.routes.node.address, &kademliaCore{k}); err == nil {
+		k.done = make(chan struct{})
+		k.running.Add(1)
+		go k.maintain(k.done)
+	}
+	return
+}
 
-	// A map of client values we've seen so far
-	seen := make(map[string]bool)
+// maintain periodically expires and republishes records and refreshes stale
+// buckets until done is closed.
+func (k *Kademlia) maintain(done chan struct{}) {
+	defer k.running.Done()
+	interval := maintenanceInterval
+	if k.RefreshInterval > 0 && k.RefreshInterval < interval {
+		interval = k.RefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Lookups under way are abandoned once the node is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			k.republish(ctx, now)
+			k.refresh(ctx, now)
+			k.saveRoutes()
+		}
+	}
+}
 
-	// Initialize the return list, frontier heap, and seen list with local nodes
-	for _, node := range k.routes.findClosest(target, delta) {
-		record := node
-		ret = append(ret, record)
-		heap.Push(frontier, *record.node)
-		seen[record.node.id.String()] = true
+// refresh looks up a random id in every bucket that has gone without a lookup
+// for longer than RefreshInterval.
+func (k *Kademlia) refresh(ctx context.Context, now time.Time) {
+	for _, bucket := range k.routes.stale(now.Add(-k.RefreshInterval)) {
+		k.iterativeFindNode(ctx, k.routes.randomIDInBucket(bucket), alpha)
 	}
+}
 
-	// Start off delta queries
-	pending := 0
-	for i := 0; i < delta && frontier.Len() > 0; i++ {
-		pending++
-		node := frontier.Pop().(Contact)
-		go k.sendFindNodeQuery(&node, target, done)
+// saveRoutes saves the routing table to RoutesFile, if set.
+func (k *Kademlia) saveRoutes() {
+	if k.RoutesFile != "" {
+		if err := k.SaveRoutes(k.RoutesFile); err != nil {
+			log.Printf("Error saving routing table: %s\n", err)
+		}
 	}
+}
 
-	// Iteratively look for closer nodes
-	for pending > 0 {
-		nodes := <-done
-		pending--
-		for _, node := range nodes {
-			// If we haven't seen the node before, add it
-			if _, ok := seen[node.id.String()]; ok == false {
-				ret = append(ret, &ContactRecord{&node, node.id.Xor(target)})
-				heap.Push(frontier, node)
-				seen[node.id.String()] = true
+func (k *Kademlia) republish(ctx context.Context, now time.Time) {
+	k.domains.expire(now)
+	for _, record := range k.domains.due(now) {
+		// Other sets travel with their registration, so that the nodes
+		// receiving them can check the owner without a lookup of their own
+		var registration *RecordSet
+		if normalizeType(record.typ) != RegistrationType {
+			held, err := k.heldRegistration(ctx, record.domain)
+			if err != nil {
+				log.Printf("Error republishing %s records for %s: %s\n", record.typ, record.domain, err)
+				continue
+			}
+			registration = &held
+		}
+		// A publisher outside the closest nodes is not sent the tombstone
+		// that deletes its set, so it looks for one before overwriting the
+		// replicas with its own copy.  Finding a newer version replaces
+		// that copy, which stops it being republished.
+		if record.published && registration != nil && !record.set.Deleted {
+			current, _ := k.iterativeFindValue(ctx, record.domain, record.typ, alpha, registration)
+			if current.Owner.Equal(record.set.Owner) && current.supersedes(&record.set) {
+				continue
 			}
 		}
+		if err := k.iterativeStore(ctx, record.domain, record.typ, record.set, registration, record.ttl); err != nil {
+			log.Printf("Error republishing %s records for %s: %s\n", record.typ, record.domain, err)
+		}
+	}
+}
+
+// rpcMessage is an RPC request or reply, each of which carries a header.
+type rpcMessage interface {
+	header() *RPCHeader
+}
 
-		for pending < delta && frontier.Len() > 0 {
-			go k.sendFindNodeQuery(frontier.Pop().(*Contact), target, done)
-			pending++
+// newHeader creates a header for a request from the node, signed over a new
+// nonce.
+func (k *Kademlia) newHeader() (header RPCHeader) {
+	header.Nonce = make([]byte, nonceSize)
+	rand.Read(header.Nonce)
+	k.sign(&header)
+	return
+}
+
+// sign fills in the node as the sender of a header and signs it.
+func (k *Kademlia) sign(header *RPCHeader) {
+	header.Sender = &k.routes.node
+	header.NetworkID = k.NetworkID
+	header.Signature = ed25519.Sign(k.key, header.signedData())
+}
+
+// verifyHeader checks that the sender of a header holds the key its id is
+// derived from, and that its id solves the network's puzzle.
+func (k *Kademlia) verifyHeader(header *RPCHeader) error {
+	if err := verifyContact(header.Sender, k.NodeDifficulty); err != nil {
+		return err
+	}
+	if !ed25519.Verify(header.Sender.key, header.signedData(), header.Signature) {
+		return fmt.Errorf("Invalid signature from %s", header.Sender)
+	}
+	return nil
+}
+
+// verifyReply checks that a reply was signed, over the nonce of the request,
+// by the node that was called.  A contact created from an address alone may
+// be answered by any node.
+func (k *Kademlia) verifyReply(contact *Contact, args, reply interface{}) error {
+	request, response := args.(rpcMessage).header(), reply.(rpcMessage).header()
+	if response.Sender == nil || !bytes.Equal(response.Nonce, request.Nonce) {
+		return fmt.Errorf("Unsigned reply from %s", contact.address)
+	}
+	if err := k.verifyHeader(response); err != nil {
+		return err
+	}
+	if !contact.id.Equals(NodeID{}) && !contact.id.Equals(response.Sender.id) {
+		return fmt.Errorf("Expected reply from %s, got %s", contact.id, response.Sender.id)
+	}
+	return nil
+}
+
+// call sends an RPC to a contact, waiting RPCTimeout for each of up to
+// RPCRetries+1 attempts, and keeps the routing table up to date with the
+// outcome.  A reply that fails verification counts as no reply.
+func (k *Kademlia) call(ctx context.Context, contact *Contact, method string, args, reply interface{}) (err error) {
+	for attempt := 0; attempt <= k.RPCRetries; attempt++ {
+		rpcCtx, cancel := context.WithTimeout(ctx, k.RPCTimeout)
+		err = k.Transport.Call(rpcCtx, contact.address, method, args, reply)
+		cancel()
+		if _, remote := err.(RemoteError); err == nil || remote || ctx.Err() != nil {
+			break
 		}
 	}
+	if err == nil {
+		err = k.verifyReply(contact, args, reply)
+	}
 
-	sort.Sort(ret)
-	if len(ret) > bucketSize {
-		ret = ret[:bucketSize]
+	// Record the responder under the id it proved, since bootstrap contacts
+	// may have been created from an address alone
+	if err == nil {
+		responder := *reply.(rpcMessage).header().Sender
+		responder.address = contact.address
+		k.update(&responder, k.routes)
+	} else if _, ok := err.(RemoteError); !ok && ctx.Err() == nil {
+		// Only nodes that fail to answer are dropped, not those that
+		// refuse a request or that we stopped waiting on
+		k.routes.remove(contact.id)
 	}
+	return
+}
+
+func (k *Kademlia) sendPingQuery(ctx context.Context, node *Contact) (err error) {
+	args := PingRequest{k.newHeader()}
+	reply := PingResponse{}
 
+	err = k.call(ctx, node, "kademliaCore.Ping", &args, &reply)
 	return
 }
 
-func (k *Kademlia) iterativeStore(domain string, typ string, ip net.IP) {
-	k.domains.storeRecord(domain, typ, ip) // store new/updated data locally
-	target := NewNodeID(fmt.Sprintf("%x", domain))
-	contacts := k.iterativeFindNode(target, 3)
+func (k *Kademlia) sendFindNodeQuery(ctx context.Context, node *Contact, target NodeID) (contacts []Contact, err error) {
+	args := FindNodeRequest{k.newHeader(), target}
+	reply := FindNodeResponse{}
+
+	err = k.call(ctx, node, "kademliaCore.FindNode", &args, &reply)
+	return reply.Contacts, err
+}
+
+func (k *Kademlia) sendFindValueQuery(ctx context.Context, node *Contact, domain string, typ string) (reply FindValueResponse, err error) {
+	args := FindValueRequest{k.newHeader(), domain, typ}
+
+	err = k.call(ctx, node, "kademliaCore.FindValue", &args, &reply)
+	return
+}
+
+func (k *Kademlia) sendstoreQuery(ctx context.Context, node *Contact, domain string, typ string, set RecordSet, registration *RecordSet, ttl time.Duration) (err error) {
+	args := StoreRequest{k.newHeader(), domain, typ, set, ttl, registration}
+	reply := StoreResponse{}
+
+	err = k.call(ctx, node, "kademliaCore.Store", &args, &reply)
+	return
+}
+
+// iterativeFindNode looks for the bucketSize nodes closest to target,
+// querying delta at a time, and returns those that responded.
+func (k *Kademlia) iterativeFindNode(ctx context.Context, target NodeID, delta int) contactRecList {
+	closest, _ := k.lookup(ctx, target, delta, func(ctx context.Context, contact *Contact) ([]Contact, error) {
+		return k.sendFindNodeQuery(ctx, contact, target)
+	}, nil)
+	return closest
+}
+
+// iterativeStore sends a record set to the nodes closest to its key, to be kept for ttl,
+// along with the domain's registration unless the set is one, giving up on
+// any not reached within the lookup's deadline.  It fails with
+// ErrNotStored unless replicaQuorum of those nodes, or all of them if there
+// are fewer, accept the set.  A node that knows of no others is the only
+// replica there can be.
+func (k *Kademlia) iterativeStore(ctx context.Context, domain string, typ string, set RecordSet, registration *RecordSet, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, k.LookupTimeout)
+	defer cancel()
+	target := k.domainKey(domain, typ)
+	alone := k.routes.findClosest(target, 1).Len() == 0
+	contacts := k.iterativeFindNode(ctx, target, alpha)
+	replicas, stored := 0, 0
 	for _, contact := range contacts {
-		if !contact.node.id.Equals(k.routes.node.id) {
-			if err := k.sendstoreQuery(contact.node, domain, typ, ip); err != nil {
-				log.Printf("Error sending store query for %s to %s\n", domain, contact.node)
+		if contact.node.id.Equals(k.routes.node.id) {
+			continue
+		}
+		replicas++
+		if ctx.Err() != nil {
+			continue
+		}
+		if err := k.sendstoreQuery(ctx, contact.node, domain, typ, set, registration, ttl); err != nil {
+			log.Printf("Error sending store query for %s to %s: %s\n", domain, contact.node, err)
+		} else {
+			stored++
+		}
+	}
+	if stored < replicaQuorum && (stored < replicas || stored == 0 && !alone) {
+		return ErrNotStored
+	}
+	return nil
+}
+
+// iterativeFindValue looks for the record set or tombstone for a domain and
+// type, ignoring any set that is not signed by its owner.  Registrations must
+// also be valid, and other sets must be signed by the owner of registration,
+// if given.  Replicas that saw different claims on a domain first may
+// disagree on its owner, so the set returned is the newest version from the
+// owner that most of the replicas answering, counting this one, hold.  The
+// lookup goes on until replicaQuorum replicas have answered with sets from
+// the same owner, or the nodes closest to the key have all answered, and any
+// that hold an older version from the winning owner are sent the newest, all
+// within the lookup's deadline.
+func (k *Kademlia) iterativeFindValue(ctx context.Context, domain string, typ string, delta int, registration *RecordSet) (set RecordSet, path contactRecList) {
+	accept := func(set *RecordSet) error {
+		if normalizeType(typ) == RegistrationType {
+			return checkRegistration(domain, set, k.Difficulty, time.Now())
+		}
+		if registration != nil && !set.Owner.Equal(registration.Owner) {
+			return ErrNotOwner
+		}
+		return nil
+	}
+
+	// Start from our own copy; its signature was verified when stored
+	var sets []RecordSet
+	local := k.domains.retrieve(domain, typ)
+	if !local.empty() && accept(&local) == nil {
+		sets = append(sets, local)
+	}
+
+	// Look for the value until enough replicas agree, remembering the
+	// holders of each version
+	ctx, cancel := context.WithTimeout(ctx, k.LookupTimeout)
+	defer cancel()
+	var mutex sync.Mutex
+	var holders []FindValueResponse
+	agree, finished := true, false
+	_, path = k.lookup(ctx, k.domainKey(domain, typ), delta, func(ctx context.Context, contact *Contact) ([]Contact, error) {
+		reply, err := k.sendFindValueQuery(ctx, contact, domain, typ)
+		if err != nil || reply.empty() {
+			return reply.Contacts, err
+		}
+		if err = reply.Verify(domain, typ); err == nil {
+			err = accept(&reply.RecordSet)
+		}
+		if err != nil {
+			log.Printf("Discarding %s records for %s from %s: %s\n", typ, domain, reply.Sender, err)
+			return reply.Contacts, nil
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if finished {
+			return nil, nil
+		}
+		if len(sets) > 0 && !reply.Owner.Equal(sets[0].Owner) {
+			agree = false
+		}
+		sets = append(sets, reply.RecordSet)
+		holders = append(holders, reply)
+		return reply.Contacts, nil
+	}, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return agree && len(sets) >= replicaQuorum
+	})
+	// Replies to queries still outstanding come too late to count
+	mutex.Lock()
+	finished = true
+	mutex.Unlock()
+	set = elect(sets)
+	if set.empty() {
+		return
+	}
+
+	// Bring replicas holding an older version, including ourselves, up to
+	// date.  Those holding another owner's registration would refuse it.
+	stale := func(held *RecordSet) bool {
+		if !held.Owner.Equal(set.Owner) {
+			return normalizeType(typ) != RegistrationType
+		}
+		return set.supersedes(held)
+	}
+	ttl := expireInterval
+	if set.Deleted {
+		ttl = tombstoneGracePeriod
+	}
+	if !local.empty() && stale(&local) {
+		k.domains.storeRecord(domain, typ, set, ttl)
+	}
+	for _, holder := range holders {
+		if stale(&holder.RecordSet) && holder.Sender != nil {
+			if err := k.sendstoreQuery(ctx, holder.Sender, domain, typ, set, registration, ttl); err != nil {
+				log.Printf("Error updating %s records for %s on %s: %s\n", typ, domain, holder.Sender, err)
 			}
 		}
 	}
+	return
 }
 
+// handleRPC checks the header of a request and signs the header of the reply.
+// A request need not name its sender, but one that does must prove it holds
+// the sender's key before the sender is added to the routing table.
 func (k *Kademlia) handleRPC(request, response *RPCHeader) error {
 	if request.NetworkID != k.NetworkID {
 		return fmt.Errorf("Expected network ID %s, got %s", k.NetworkID, request.NetworkID)
 	}
 	if request.Sender != nil {
+		if err := k.verifyHeader(request); err != nil {
+			return err
+		}
 		k.update(request.Sender, k.routes)
 	}
-	response.Sender = &k.routes.node
+	response.Nonce = request.Nonce
+	k.sign(response)
 	return nil
 }
 
-func (kc *kademliaCore) ping(args *pingRequest, response *pingResponse) (err error) {
+func (kc *kademliaCore) Ping(args *PingRequest, response *PingResponse) (err error) {
 	if err = kc.kad.handleRPC(&args.RPCHeader, &response.RPCHeader); err == nil {
-		log.Printf("ping from %s\n", args.RPCHeader)
+		log.Printf("ping from %s\n", args.Sender)
 	}
 	return
 }
 
-func (kc *kademliaCore) store(args *storeRequest, response *storeResponse) (err error) {
-	if err = kc.kad.handleRPC(&args.RPCHeader, &response.RPCHeader); err == nil {
-		kc.kad.domains.storeRecord(args.domain, args.typ, args.ip)
+func (kc *kademliaCore) Store(args *StoreRequest, response *StoreResponse) (err error) {
+	if err = kc.kad.handleRPC(&args.RPCHeader, &response.RPCHeader); err != nil {
+		return
 	}
-	return
+	if normalizeType(args.Type) == RegistrationType {
+		err = checkRegistration(args.Domain, &args.RecordSet, kc.kad.Difficulty, time.Now())
+	} else {
+		err = kc.kad.checkOwner(args.Domain, &args.RecordSet, args.Registration)
+	}
+	if err != nil {
+		return
+	}
+	return kc.kad.domains.storeRecord(args.Domain, args.Type, args.RecordSet, args.TTL)
 }
 
-func (kc *kademliaCore) findNode(args *findNodeRequest, response *findNodeResponse) (err error) {
+func (kc *kademliaCore) FindNode(args *FindNodeRequest, response *FindNodeResponse) (err error) {
 	if err = kc.kad.handleRPC(&args.RPCHeader, &response.RPCHeader); err == nil {
-		contacts := kc.kad.routes.findClosest(args.target, bucketSize)
-		response.contacts = make([]Contact, contacts.Len())
+		contacts := kc.kad.routes.findClosest(args.Target, bucketSize)
+		response.Contacts = make([]Contact, contacts.Len())
 
 		for i := 0; i < contacts.Len(); i++ {
-			response.contacts[i] = *contacts[i].node
+			response.Contacts[i] = *contacts[i].node
 		}
 	}
 	return
 }
 
-func (kc *kademliaCore) findValue(args *findValueRequest, response *findValueResponse) (err error) {
+func (kc *kademliaCore) FindValue(args *FindValueRequest, response *FindValueResponse) (err error) {
 	if err = kc.kad.handleRPC(&args.RPCHeader, &response.RPCHeader); err == nil {
-		val := kc.kad.domains.retrieve(args.domain, args.typ)
-		if val != nil {
-			response.ip = val
+		val := kc.kad.domains.retrieve(args.Domain, args.Type)
+		if !val.empty() {
+			response.RecordSet = val
 		} else {
-			response.ip = nil
-			target := NewNodeID(fmt.Sprintf("%x", args.domain))
+			target := kc.kad.domainKey(args.Domain, args.Type)
 			contacts := kc.kad.routes.findClosest(target, bucketSize)
+			response.Contacts = make([]Contact, contacts.Len())
 			for i := 0; i < contacts.Len(); i++ {
-				response.contacts[i] = *contacts[i].node
+				response.Contacts[i] = *contacts[i].node
 			}
 		}
 	}
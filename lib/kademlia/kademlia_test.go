@@ -1,98 +1,627 @@
 package kademlia
 
 import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
 	"net"
+	"sync"
 	"testing"
+	"time"
 )
 
+// newTestNode creates a node reachable at address with a new key, which only
+// solves the quick puzzle of testNodeDifficulty.
+func newTestNode(address string) *Kademlia {
+	key, err := NewNodeKey(testNodeDifficulty)
+	if err != nil {
+		panic(err)
+	}
+	k := NewKademlia(key, address, "test")
+	k.NodeDifficulty = testNodeDifficulty
+	return k
+}
+
 func TestPing(t *testing.T) {
-	me := Contact{NewRandomNodeID(), "127.0.0.1:8989"}
-	k := NewKademlia(&me, "test")
-	k.serve()
+	k := newTestNode("127.0.0.1:8989")
+	if err := k.serve(); err != nil {
+		t.Fatalf("Error serving on %s: %s", k.routes.node.address, err)
+	}
+	defer k.Close()
 
-	someone := Contact{NewRandomNodeID(), "127.0.0.1:8989"}
-	if err := k.sendPingQuery(&someone); err != nil {
+	// A contact known by its address alone may be answered by any node, but
+	// one known by its id only by that node
+	someone := NewContact(NodeID{}, k.routes.node.address)
+	if err := k.sendPingQuery(context.Background(), &someone); err != nil {
 		t.Errorf("Error on sending ping query: %s", err)
 	}
+	impostor := NewContact(NewRandomNodeID(), k.routes.node.address)
+	if err := k.sendPingQuery(context.Background(), &impostor); err == nil {
+		t.Errorf("Expected ping answered by another node than %s to fail", impostor.id)
+	}
+}
+
+func TestSignedHeaders(t *testing.T) {
+	k := newTestNode("127.0.0.1:8989")
+	kc := kademliaCore{k}
+	sender := newTestNode("127.0.0.1:8990")
+
+	header := sender.newHeader()
+	if err := kc.Ping(&PingRequest{header}, &PingResponse{}); err != nil {
+		t.Errorf("Error on Ping with a signed header: %s", err)
+	}
+	if findContact(k.routes.buckets[k.routes.bucketIndex(sender.routes.node.id)], sender.routes.node.id) == nil {
+		t.Errorf("Expected %s to be added to the routing table", &sender.routes.node)
+	}
+
+	// A sender cannot claim an id other than the one its key gives, nor
+	// have its header altered on the way
+	forged := sender.newHeader()
+	forged.Sender = &Contact{NewRandomNodeID(), sender.routes.node.address, sender.routes.node.key}
+	if err := kc.Ping(&PingRequest{forged}, &PingResponse{}); err == nil {
+		t.Errorf("Expected error for a sender whose id does not match its key")
+	}
+	altered := sender.newHeader()
+	altered.Nonce = header.Nonce
+	if err := kc.Ping(&PingRequest{altered}, &PingResponse{}); err == nil {
+		t.Errorf("Expected error for a header whose signature does not match")
+	}
+	k.NodeDifficulty = 64
+	if err := kc.Ping(&PingRequest{sender.newHeader()}, &PingResponse{}); err == nil {
+		t.Errorf("Expected error for a sender whose id has too little work")
+	}
+	k.NodeDifficulty = testNodeDifficulty
+
+	// A reply must be signed over the nonce of the request it answers
+	request, reply := PingRequest{sender.newHeader()}, PingResponse{}
+	if err := kc.Ping(&request, &reply); err != nil {
+		t.Fatalf("Error on Ping: %s", err)
+	}
+	if err := sender.verifyReply(&k.routes.node, &request, &reply); err != nil {
+		t.Errorf("Error verifying reply: %s", err)
+	}
+	if err := sender.verifyReply(&k.routes.node, &PingRequest{sender.newHeader()}, &reply); err == nil {
+		t.Errorf("Expected error verifying a reply to another request")
+	}
 }
 
 func TestFindNode(t *testing.T) {
-	me := Contact{NewRandomNodeID(), "127.0.0.1:8989"}
-	k := NewKademlia(&me, "test")
+	k := newTestNode("127.0.0.1:8989")
 	kc := kademliaCore{k}
 
 	var contacts [100]Contact
 	for i := 0; i < len(contacts); i++ {
-		contacts[i] = Contact{NewRandomNodeID(), "127.0.0.1:8989"}
-		if err := kc.ping(&pingRequest{RPCHeader{&contacts[i], k.NetworkID}},
-			&pingResponse{}); err != nil {
+		sender := newTestNode("127.0.0.1:8989")
+		contacts[i] = sender.routes.node
+		if err := kc.Ping(&PingRequest{sender.newHeader()},
+			&PingResponse{}); err != nil {
 			t.Errorf("Error on Ping %d: %s", i, err)
 		}
 	}
 
-	args := findNodeRequest{RPCHeader{&contacts[0], k.NetworkID}, contacts[0].id}
-	response := findNodeResponse{}
-	if err := kc.findNode(&args, &response); err != nil {
+	args := FindNodeRequest{RPCHeader{NetworkID: k.NetworkID}, contacts[0].id}
+	response := FindNodeResponse{}
+	if err := kc.FindNode(&args, &response); err != nil {
 		t.Errorf("Error on finding nodes: %s", err)
 	}
 
-	if len(response.contacts) != bucketSize {
-		t.Errorf("Expected 'full' bucket of %d contacts: received %d", bucketSize, len(response.contacts))
+	if len(response.Contacts) != bucketSize {
+		t.Errorf("Expected 'full' bucket of %d contacts: received %d", bucketSize, len(response.Contacts))
 	}
 }
 
 func TestStore(t *testing.T) {
-	me := Contact{NewRandomNodeID(), "127.0.0.1:8989"}
-	k := NewKademlia(&me, "test")
+	k := newTestNode("127.0.0.1:8989")
 	kc := kademliaCore{k}
-	someone := Contact{NewRandomNodeID(), "127.0.0.1:8989"}
-	args := storeRequest{RPCHeader{&me, k.NetworkID}, "www.google.com", "A", net.ParseIP("74.125.224.72")}
-	response := storeResponse{}
+	remote := newTestNode("127.0.0.1:8990")
+	someone := remote.routes.node
+	if err := remote.serve(); err != nil {
+		t.Fatalf("Error serving on %s: %s", someone.address, err)
+	}
+	defer remote.Close()
 
-	if err := k.call(&someone, "kademliaCore.Store", &args, &response); err != nil {
+	// Records are only taken from the owner of the registration sent with
+	// them, which the receiver checks without looking it up
+	ip := net.ParseIP("74.125.224.72")
+	args := StoreRequest{k.newHeader(), "www.google.com", "A", signed("www.google.com", "A", Record{IP: ip, TTL: DefaultTTL}), time.Hour, nil}
+	response := StoreResponse{}
+	if err := k.call(context.Background(), &someone, "kademliaCore.Store", &args, &response); err == nil {
+		t.Errorf("Expected remote node to refuse records without a registration")
+	}
+	claim := NewRegistration(testKey, "www.google.com", 1, time.Now(), time.Now().Add(time.Hour), testDifficulty)
+	for _, node := range []*Kademlia{k, remote} {
+		node.Difficulty = testDifficulty
+	}
+
+	args = StoreRequest{k.newHeader(), "www.google.com", "A", signed("www.google.com", "A", Record{IP: ip, TTL: DefaultTTL}), time.Hour, &claim}
+
+	if err := k.call(context.Background(), &someone, "kademliaCore.Store", &args, &response); err != nil {
 		t.Errorf("Error storing www.google.com on remote node %s: %s", someone.String(), err)
 	}
+	if stored := remote.domains.retrieve("www.google.com", "A").Records; !onlyIP(stored).Equal(ip) {
+		t.Errorf("Expected remote node to hold %s for www.google.com, found %v", ip, stored)
+	}
+	if !response.Sender.id.Equals(someone.id) {
+		t.Errorf("Expected response from %s, received %s", someone.id, response.Sender.id)
+	}
+
+	if err := kc.Store(&args, &response); err != nil {
+		t.Errorf("Error storing www.google.com on local node %s: %s", k.routes.node.String(), err)
+	}
 
-	if err := kc.store(&args, &response); err != nil {
-		t.Errorf("Error storing www.google.com on local node %s: %s", me.String(), err)
+	// Nodes refuse records from anyone but the registered owner
+	_, other, _ := ed25519.GenerateKey(nil)
+	args.RecordSet = SignRecords(other, "www.google.com", "A", nextSequence(0), []Record{{IP: net.ParseIP("10.0.0.1"), TTL: DefaultTTL}})
+	if err := k.call(context.Background(), &someone, "kademliaCore.Store", &args, &response); err == nil {
+		t.Errorf("Expected remote node to refuse records signed by another key")
+	}
+
+	// or from another registration than the one they hold
+	if err := remote.domains.storeRecord("www.google.com", RegistrationType, claim, time.Hour); err != nil {
+		t.Fatalf("Error storing registration: %s", err)
+	}
+	rival := NewRegistration(other, "www.google.com", 1, time.Now(), time.Now().Add(time.Hour), testDifficulty)
+	args.Registration = &rival
+	if err := k.call(context.Background(), &someone, "kademliaCore.Store", &args, &response); err == nil {
+		t.Errorf("Expected remote node to refuse records under a rival registration")
+	}
+	if stored := remote.domains.retrieve("www.google.com", "A").Records; !onlyIP(stored).Equal(ip) {
+		t.Errorf("Expected remote node to keep %s for www.google.com, found %v", ip, stored)
 	}
 }
 
 func TestIterativeFindNode(t *testing.T) {
-	me := Contact{NewRandomNodeID(), "127.0.0.1:8989"}
-	k := NewKademlia(&me, "test")
+	k := newTestNode("127.0.0.1:8989")
 	kc := kademliaCore{k}
 
 	var contacts [100]Contact
 	for i := 0; i < len(contacts); i++ {
-		contacts[i] = Contact{NewRandomNodeID(), "127.0.0.1:8989"}
-		if err := kc.ping(&pingRequest{RPCHeader{&contacts[i], k.NetworkID}},
-			&pingResponse{}); err != nil {
+		sender := newTestNode("127.0.0.1:8989")
+		contacts[i] = sender.routes.node
+		if err := kc.Ping(&PingRequest{sender.newHeader()},
+			&PingResponse{}); err != nil {
 			t.Errorf("Error on Ping %d: %s", i, err)
 		}
 	}
 
 	var contactRecords contactRecList
 
-	contactRecords = k.iterativeFindNode(contacts[0].id, 5)
+	contactRecords = k.iterativeFindNode(context.Background(), contacts[0].id, 5)
 	if len(contactRecords) > bucketSize {
 		t.Errorf("Returned more than expected %d records: returned %d", bucketSize, len(contactRecords))
 	}
 }
 
 func TestIterativeStore(t *testing.T) {
-	me := Contact{NewRandomNodeID(), "127.0.0.1:8989"}
-	k := NewKademlia(&me, "test")
+	k := newTestNode("127.0.0.1:8989")
+	kc := kademliaCore{k}
+
+	var contacts [100]Contact
+	for i := 0; i < len(contacts); i++ {
+		sender := newTestNode("127.0.0.1:8989")
+		contacts[i] = sender.routes.node
+		if err := kc.Ping(&PingRequest{sender.newHeader()},
+			&PingResponse{}); err != nil {
+			t.Errorf("Error on Ping %d: %s", i, err)
+		}
+	}
+
+	// None of the contacts are serving, so none of them can take the set
+	set := signed("www.google.com", "A", Record{IP: net.ParseIP("74.125.224.72"), TTL: DefaultTTL})
+	if err := k.iterativeStore(context.Background(), "www.google.com", "A", set, nil, expireInterval); err != ErrNotStored {
+		t.Errorf("Expected ErrNotStored with no contact reachable, received %v", err)
+	}
+}
+
+func TestFindValue(t *testing.T) {
+	k := newTestNode("127.0.0.1:8989")
 	kc := kademliaCore{k}
 
 	var contacts [100]Contact
 	for i := 0; i < len(contacts); i++ {
-		contacts[i] = Contact{NewRandomNodeID(), "127.0.0.1:8989"}
-		if err := kc.ping(&pingRequest{RPCHeader{&contacts[i], k.NetworkID}},
-			&pingResponse{}); err != nil {
+		sender := newTestNode("127.0.0.1:8989")
+		contacts[i] = sender.routes.node
+		if err := kc.Ping(&PingRequest{sender.newHeader()},
+			&PingResponse{}); err != nil {
 			t.Errorf("Error on Ping %d: %s", i, err)
 		}
 	}
 
-	k.iterativeStore("www.google.com", "A", net.ParseIP("74.125.224.72"))
+	ip := net.ParseIP("74.125.224.72")
+	k.domains.storeRecord("www.google.com", "A", signed("www.google.com", "A", Record{IP: ip, TTL: DefaultTTL}), expireInterval)
+
+	args := FindValueRequest{RPCHeader{NetworkID: k.NetworkID}, "www.google.com", "A"}
+	response := FindValueResponse{}
+	if err := kc.FindValue(&args, &response); err != nil {
+		t.Errorf("Error on finding value: %s", err)
+	}
+	if !onlyIP(response.Records).Equal(ip) {
+		t.Errorf("Expected %s for www.google.com, received %v", ip, response.Records)
+	}
+
+	args = FindValueRequest{RPCHeader{NetworkID: k.NetworkID}, "www.facebook.com", "A"}
+	response = FindValueResponse{}
+	if err := kc.FindValue(&args, &response); err != nil {
+		t.Errorf("Error on finding value: %s", err)
+	}
+	if response.Records != nil {
+		t.Errorf("Expected no record for www.facebook.com, received %v", response.Records)
+	}
+	if len(response.Contacts) != bucketSize {
+		t.Errorf("Expected 'full' bucket of %d contacts: received %d", bucketSize, len(response.Contacts))
+	}
+}
+
+func TestIterativeFindValue(t *testing.T) {
+	k := newTestNode("127.0.0.1:8989")
+	kc := kademliaCore{k}
+
+	var contacts [100]Contact
+	for i := 0; i < len(contacts); i++ {
+		sender := newTestNode("127.0.0.1:8989")
+		contacts[i] = sender.routes.node
+		if err := kc.Ping(&PingRequest{sender.newHeader()},
+			&PingResponse{}); err != nil {
+			t.Errorf("Error on Ping %d: %s", i, err)
+		}
+	}
+
+	ip := net.ParseIP("74.125.224.72")
+	k.domains.storeRecord("www.google.com", "A", signed("www.google.com", "A", Record{IP: ip, TTL: DefaultTTL}), expireInterval)
+	if found, _ := k.iterativeFindValue(context.Background(), "www.google.com", "A", 3, nil); !onlyIP(found.Records).Equal(ip) {
+		t.Errorf("Expected local hit %s, received %v", ip, found)
+	}
+
+	found, path := k.iterativeFindValue(context.Background(), "www.facebook.com", "A", 3, nil)
+	if found.Records != nil {
+		t.Errorf("Expected no record for www.facebook.com, received %v", found)
+	}
+	if len(path) == 0 {
+		t.Errorf("Expected lookup to query at least one contact")
+	}
+}
+
+func TestJoinPutGet(t *testing.T) {
+	nodes := make([]*Kademlia, 5)
+	for i := range nodes {
+		nodes[i] = newTestNode(fmt.Sprintf("127.0.0.1:%d", 9000+i))
+		nodes[i].Difficulty = testDifficulty
+		defer nodes[i].Close()
+	}
+
+	if err := nodes[0].Join(context.Background()); err != nil {
+		t.Fatalf("Error starting network: %s", err)
+	}
+	for i := 1; i < len(nodes); i++ {
+		// Bootstrap from the address alone, as a user would from a seed list
+		if err := nodes[i].Join(context.Background(), NewContact(NodeID{}, nodes[i-1].routes.node.address)); err != nil {
+			t.Fatalf("Error joining node %d: %s", i, err)
+		}
+	}
+
+	// Every node should have learned of the others while joining
+	for i, k := range nodes {
+		if known := k.Stats().Contacts; known != len(nodes)-1 {
+			t.Errorf("Node %d expected %d contacts after join, has %d", i, len(nodes)-1, known)
+		}
+	}
+
+	ip := net.ParseIP("74.125.224.72")
+	register(t, nodes[len(nodes)-1], "www.google.com")
+	if err := nodes[len(nodes)-1].Put(context.Background(), testKey, "www.google.com", "A", Record{IP: ip}); err != nil {
+		t.Errorf("Error putting www.google.com: %s", err)
+	}
+
+	for i, k := range nodes {
+		if found, err := k.Get(context.Background(), "www.google.com", "A"); err != nil || !onlyIP(found).Equal(ip) {
+			t.Errorf("Node %d expected %s for www.google.com, received %v (%v)", i, ip, found, err)
+		}
+	}
+
+	// Every record in a set comes back, each with its own TTL
+	set := []Record{
+		{IP: net.ParseIP("69.63.176.13"), TTL: time.Minute},
+		{IP: net.ParseIP("69.63.176.14"), TTL: time.Hour},
+	}
+	register(t, nodes[0], "www.facebook.com")
+	if err := nodes[0].Put(context.Background(), testKey, "www.facebook.com", "A", set...); err != nil {
+		t.Errorf("Error putting www.facebook.com: %s", err)
+	}
+	if found, err := nodes[len(nodes)-1].Get(context.Background(), "www.facebook.com", "A"); err != nil || !sameRecords(found, set) {
+		t.Errorf("Expected record set %v for www.facebook.com, received %v (%v)", set, found, err)
+	}
+
+	// Typed record data survives the trip through the network
+	mx := []Record{
+		{Priority: 10, Host: "mx1.example.com"},
+		{Priority: 20, Host: "mx2.example.com", TTL: time.Hour},
+	}
+	register(t, nodes[1], "example.com")
+	if err := nodes[1].Put(context.Background(), testKey, "example.com", "MX", mx...); err != nil {
+		t.Errorf("Error putting example.com MX: %s", err)
+	}
+	mx[0].TTL = DefaultTTL
+	if found, err := nodes[0].Get(context.Background(), "example.com", "MX"); err != nil || !sameRecords(found, mx) {
+		t.Errorf("Expected MX records %v for example.com, received %v (%v)", mx, found, err)
+	}
+
+	if _, err := nodes[0].Get(context.Background(), "example.com", "A"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for missing record, received %v", err)
+	}
+	if err := nodes[0].Put(context.Background(), testKey, "", "A", Record{IP: ip}); err == nil {
+		t.Errorf("Expected error putting record with no domain")
+	}
+	if err := nodes[0].Put(context.Background(), testKey, "www.google.com", "A"); err == nil {
+		t.Errorf("Expected error putting an empty record set")
+	}
+}
+
+func TestJoinUnreachable(t *testing.T) {
+	k := newTestNode("127.0.0.1:9010")
+	defer k.Close()
+
+	if err := k.Join(context.Background(), NewContact(NodeID{}, "127.0.0.1:9011")); err == nil {
+		t.Errorf("Expected error joining through unreachable bootstrap contact")
+	}
+}
+
+func TestUpdateFullBucket(t *testing.T) {
+	network := NewSimNetwork(1)
+	k := newTestNode("local")
+	k.Transport = network.NewTransport()
+
+	// Live nodes fill bucket 0, which holds half of all ids
+	var remotes []*Kademlia
+	for i := 0; len(remotes) < bucketSize; i++ {
+		remote := newTestNode(fmt.Sprintf("node%d", i))
+		if k.routes.bucketIndex(remote.routes.node.id) != 0 {
+			continue
+		}
+		remote.Transport = network.NewTransport()
+		if err := remote.serve(); err != nil {
+			t.Fatalf("Error serving on %s: %s", remote.routes.node.address, err)
+		}
+		defer remote.Close()
+		remotes = append(remotes, remote)
+		k.update(&remote.routes.node, k.routes)
+	}
+	newcomer := newTestNode("newcomer").routes.node
+	for k.routes.bucketIndex(newcomer.id) != 0 {
+		newcomer = newTestNode("newcomer").routes.node
+	}
+
+	// The eviction ping to the bucket's last contact does not hold up the
+	// update, and the live contact keeps its place
+	network.SetLatency(100 * time.Millisecond)
+	last := k.routes.buckets[0].Back().Value.(*Contact)
+	start := time.Now()
+	k.update(&newcomer, k.routes)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Expected update not to wait for the eviction ping, took %s", elapsed)
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, pinging := k.evicting.Load(last.id); !pinging {
+			break
+		}
+	}
+	network.SetLatency(0)
+	if findContact(k.routes.buckets[0], last.id) == nil {
+		t.Errorf("Expected live contact %s to stay in its bucket", last)
+	}
+
+	stats := k.Stats()
+	if stats.Buckets[0].Contacts != bucketSize || stats.Buckets[0].Replacements != 1 {
+		t.Errorf("Expected full bucket with 1 replacement, found %d contacts and %d replacements",
+			stats.Buckets[0].Contacts, stats.Buckets[0].Replacements)
+	}
+
+	// Once the bucket's contacts stop answering, the replacement is promoted
+	for _, remote := range remotes {
+		remote.Close()
+	}
+	last = k.routes.buckets[0].Back().Value.(*Contact)
+	if err := k.sendPingQuery(context.Background(), last); err == nil {
+		t.Fatalf("Expected ping to closed node %s to fail", last)
+	}
+	if findContact(k.routes.buckets[0], last.id) != nil {
+		t.Errorf("Expected %s to be dropped after failed ping", last)
+	}
+	if findContact(k.routes.buckets[0], newcomer.id) == nil {
+		t.Errorf("Expected replacement %s to be promoted", &newcomer)
+	}
+	if stats = k.Stats(); stats.Replacements != 0 {
+		t.Errorf("Expected empty replacement cache, found %d", stats.Replacements)
+	}
+}
+
+func TestRepublish(t *testing.T) {
+	a := newTestNode("127.0.0.1:9030")
+	b := newTestNode("127.0.0.1:9031")
+	a.Difficulty, b.Difficulty = testDifficulty, testDifficulty
+	defer a.Close()
+	defer b.Close()
+
+	if err := a.Join(context.Background()); err != nil {
+		t.Fatalf("Error starting network: %s", err)
+	}
+	if err := b.Join(context.Background(), a.routes.node); err != nil {
+		t.Fatalf("Error joining network: %s", err)
+	}
+
+	// The registration must outlast the republish for the replica to take it
+	ip := net.ParseIP("74.125.224.72")
+	if err := a.Register(context.Background(), testKey, "www.google.com", 2*republishInterval); err != nil {
+		t.Fatalf("Error registering www.google.com: %s", err)
+	}
+	if err := a.Put(context.Background(), testKey, "www.google.com", "A", Record{IP: ip}); err != nil {
+		t.Fatalf("Error putting www.google.com: %s", err)
+	}
+	if stored := b.domains.retrieve("www.google.com", "A").Records; !onlyIP(stored).Equal(ip) {
+		t.Fatalf("Expected replica %s on second node, found %v", ip, stored)
+	}
+
+	// Once its copy has expired, the replica only comes back when the
+	// original publisher republishes a day later
+	now := time.Now()
+	b.republish(context.Background(), now.Add(expireInterval))
+	if stored := b.domains.retrieve("www.google.com", "A").Records; stored != nil {
+		t.Errorf("Expected replica to expire, found %v", stored)
+	}
+
+	a.republish(context.Background(), now.Add(replicateInterval))
+	if stored := b.domains.retrieve("www.google.com", "A").Records; stored != nil {
+		t.Errorf("Expected no republish within a day, found %v", stored)
+	}
+
+	a.republish(context.Background(), now.Add(republishInterval))
+	if stored := b.domains.retrieve("www.google.com", "A").Records; !onlyIP(stored).Equal(ip) {
+		t.Errorf("Expected republished replica %s, found %v", ip, stored)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	a := newTestNode("127.0.0.1:9040")
+	b := newTestNode("127.0.0.1:9041")
+	defer a.Close()
+	defer b.Close()
+
+	b.RefreshInterval = time.Minute
+	if err := a.Join(context.Background()); err != nil {
+		t.Fatalf("Error starting network: %s", err)
+	}
+	if err := b.Join(context.Background(), a.routes.node); err != nil {
+		t.Fatalf("Error joining network: %s", err)
+	}
+
+	stale := time.Now().Add(-time.Hour)
+	b.routes.mutex.Lock()
+	for i := range b.routes.lastLookup {
+		b.routes.lastLookup[i] = stale
+	}
+	b.routes.mutex.Unlock()
+
+	b.refresh(context.Background(), time.Now())
+	stats := b.Stats()
+	for i := 0; i <= b.routes.closestBucket(); i++ {
+		if !stats.Buckets[i].LastLookup.After(stale) {
+			t.Errorf("Expected bucket %d to be refreshed", i)
+		}
+	}
+	for i := b.routes.closestBucket() + 1; i < idLength*8; i++ {
+		if stats.Buckets[i].LastLookup.After(stale) {
+			t.Errorf("Expected bucket %d beyond closest neighbor to be left alone", i)
+		}
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	a := newTestNode("127.0.0.1:9050")
+	b := newTestNode("127.0.0.1:9051")
+	a.Difficulty, b.Difficulty = testDifficulty, testDifficulty
+	defer a.Close()
+	defer b.Close()
+
+	if err := a.Join(context.Background()); err != nil {
+		t.Fatalf("Error starting network: %s", err)
+	}
+	if err := b.Join(context.Background(), a.routes.node); err != nil {
+		t.Fatalf("Error joining network: %s", err)
+	}
+
+	// Lookups and stores from b are served by a's RPC goroutines while a is
+	// also updating its own table and store.  Keep the unreachable senders
+	// below a bucket's worth so they cannot crowd out the live nodes.
+	var wg sync.WaitGroup
+	kc := kademliaCore{a}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			domain := fmt.Sprintf("host%d.example.com", i)
+			ip := net.IPv4(10, 0, 0, byte(i))
+			if err := b.Register(context.Background(), testKey, domain, time.Hour); err != nil {
+				t.Errorf("Error registering %s: %s", domain, err)
+			}
+			if err := b.Put(context.Background(), testKey, domain, "A", Record{IP: ip}); err != nil {
+				t.Errorf("Error putting %s: %s", domain, err)
+			}
+			if found, err := a.Get(context.Background(), domain, "A"); err != nil || !onlyIP(found).Equal(ip) {
+				t.Errorf("Expected %s for %s, received %v (%v)", ip, domain, found, err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			sender := newTestNode("127.0.0.1:9052")
+			kc.Ping(&PingRequest{sender.newHeader()}, &PingResponse{})
+			a.routes.findClosest(sender.routes.node.id, bucketSize)
+			a.Stats()
+		}()
+	}
+	wg.Wait()
+}
+
+// flakyTransport fails the first calls made through it, as though the
+// messages had been lost.
+type flakyTransport struct {
+	Transport
+	failures int
+	calls    int
+}
+
+func (t *flakyTransport) Call(ctx context.Context, address string, method string, args, reply interface{}) error {
+	if t.calls++; t.calls <= t.failures {
+		return fmt.Errorf("Call %d to %s lost", t.calls, address)
+	}
+	return t.Transport.Call(ctx, address, method, args, reply)
+}
+
+func TestCallRetries(t *testing.T) {
+	network := NewSimNetwork(1)
+	remote := newTestNode("remote")
+	remote.Transport = network.NewTransport()
+	if err := remote.Join(context.Background()); err != nil {
+		t.Fatalf("Error starting network: %s", err)
+	}
+	defer remote.Close()
+
+	k := newTestNode("local")
+	flaky := &flakyTransport{Transport: network.NewTransport()}
+	k.Transport = flaky
+	if err := k.Join(context.Background(), remote.routes.node); err != nil {
+		t.Fatalf("Error joining network: %s", err)
+	}
+	defer k.Close()
+	contact := remote.routes.node
+
+	// One lost message is retried
+	flaky.failures, flaky.calls = 1, 0
+	if err := k.sendPingQuery(context.Background(), &contact); err != nil {
+		t.Errorf("Expected ping to succeed on retry: %s", err)
+	}
+	if flaky.calls != 2 {
+		t.Errorf("Expected 2 attempts, found %d", flaky.calls)
+	}
+
+	// Giving up on a call leaves the contact in place
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	flaky.failures, flaky.calls = 0, 0
+	if err := k.sendPingQuery(ctx, &contact); err == nil {
+		t.Errorf("Expected ping with a cancelled context to fail")
+	}
+	if flaky.calls != 1 {
+		t.Errorf("Expected no retries after cancellation, found %d attempts", flaky.calls)
+	}
+	if findContact(k.routes.buckets[k.routes.bucketIndex(contact.id)], contact.id) == nil {
+		t.Errorf("Expected %s to survive a cancelled ping", &contact)
+	}
+
+	// Running out of retries drops it
+	flaky.failures, flaky.calls = k.RPCRetries+1, 0
+	if err := k.sendPingQuery(context.Background(), &contact); err == nil {
+		t.Errorf("Expected ping to fail once retries run out")
+	}
+	if findContact(k.routes.buckets[k.routes.bucketIndex(contact.id)], contact.id) != nil {
+		t.Errorf("Expected %s to be dropped after failing every attempt", &contact)
+	}
 }
@@ -0,0 +1,54 @@
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// LoadKey reads an Ed25519 private key stored as its hex encoded seed,
+// generating and saving a new key if the file does not exist yet.
+func LoadKey(path string) (key ed25519.PrivateKey, err error) {
+	return loadKey(path, func() (key ed25519.PrivateKey, err error) {
+		_, key, err = ed25519.GenerateKey(nil)
+		return
+	})
+}
+
+// LoadNodeKey reads a node key stored as by LoadKey, generating and saving a
+// new key whose id solves the static puzzle with difficulty leading zero bits
+// if the file does not exist yet.
+func LoadNodeKey(path string, difficulty int) (key ed25519.PrivateKey, err error) {
+	return loadKey(path, func() (ed25519.PrivateKey, error) {
+		return NewNodeKey(difficulty)
+	})
+}
+
+// ReadKey reads a key stored as by LoadKey, failing if the file does not
+// exist rather than generating a new key.
+func ReadKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("Invalid key in %s", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func loadKey(path string, generate func() (ed25519.PrivateKey, error)) (key ed25519.PrivateKey, err error) {
+	key, err = ReadKey(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if key, err = generate(); err != nil {
+			return
+		}
+		err = os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600)
+	}
+	return
+}
@@ -0,0 +1,69 @@
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	key, err := LoadKey(path)
+	if err != nil {
+		t.Fatalf("Error creating key: %s", err)
+	}
+
+	loaded, err := LoadKey(path)
+	if err != nil {
+		t.Fatalf("Error loading key: %s", err)
+	}
+	if !loaded.Equal(key) {
+		t.Errorf("Expected the saved key to be loaded again")
+	}
+
+	if err := os.WriteFile(path, []byte("not a key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKey(path); err == nil {
+		t.Errorf("Expected error loading malformed key file")
+	}
+}
+
+func TestReadKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	if _, err := ReadKey(path); err == nil {
+		t.Errorf("Expected error reading a missing key file")
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("Expected no key to be created by reading")
+	}
+
+	key, err := LoadKey(path)
+	if err != nil {
+		t.Fatalf("Error creating key: %s", err)
+	}
+	if read, err := ReadKey(path); err != nil || !read.Equal(key) {
+		t.Errorf("Expected the saved key to be read, received %v", err)
+	}
+}
+
+func TestLoadNodeKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodekey")
+	key, err := LoadNodeKey(path, testNodeDifficulty)
+	if err != nil {
+		t.Fatalf("Error creating node key: %s", err)
+	}
+	if id := NodeIDFromKey(key.Public().(ed25519.PublicKey)); nodeWork(id) < testNodeDifficulty {
+		t.Errorf("Expected a new node key to solve the puzzle, found %d bits of work", nodeWork(id))
+	}
+
+	// The node keeps its id across restarts
+	loaded, err := LoadNodeKey(path, testNodeDifficulty)
+	if err != nil {
+		t.Fatalf("Error loading node key: %s", err)
+	}
+	if !loaded.Equal(key) {
+		t.Errorf("Expected the saved node key to be loaded again")
+	}
+}
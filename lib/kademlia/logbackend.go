@@ -0,0 +1,204 @@
+package kademlia
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Limits for LogBackend
+const (
+	logCompactMin = 1024    // entries a log holds before it may be compacted
+	maxLogEntry   = 1 << 24 // longest entry accepted when reading a log
+)
+
+// errLogClosed is returned for changes made after a LogBackend is closed.
+var errLogClosed = errors.New("Record log is closed")
+
+// logEntry is one change appended to a LogBackend's file.
+type logEntry struct {
+	Record  StoredRecord
+	Removed bool
+}
+
+// LogBackend saves records to an append-only log, each change written as a
+// checksummed entry and synced to disk before the call returns.  Once most of
+// the log is superseded entries it is compacted by writing the live records to
+// a new file and renaming that over the old one, so a crash at any point
+// leaves a complete log behind.  An entry torn by a crash is dropped when the
+// log is opened again.
+type LogBackend struct {
+	path    string
+	file    *os.File
+	records map[string]StoredRecord
+	entries int // entries in the file, superseded or not
+}
+
+// OpenLogBackend opens the record log at path, creating it if it does not
+// exist.
+func OpenLogBackend(path string) (*LogBackend, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	b := &LogBackend{path: path, records: make(map[string]StoredRecord)}
+	valid, err := b.replay(file)
+	if err == nil {
+		err = file.Truncate(valid)
+	}
+	if err == nil {
+		_, err = file.Seek(valid, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	b.file = file
+	return b, nil
+}
+
+// replay applies the entries read from a log, returning the offset just past
+// the last intact one.
+func (b *LogBackend) replay(r io.Reader) (valid int64, err error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, 8)
+	for {
+		if _, err = io.ReadFull(reader, header); err != nil {
+			break
+		}
+		length, sum := binary.BigEndian.Uint32(header), binary.BigEndian.Uint32(header[4:])
+		if length > maxLogEntry {
+			break
+		}
+		data := make([]byte, length)
+		if _, err = io.ReadFull(reader, data); err != nil {
+			break
+		}
+		var entry logEntry
+		if crc32.ChecksumIEEE(data) != sum || gob.NewDecoder(bytes.NewReader(data)).Decode(&entry) != nil {
+			break
+		}
+		b.apply(&entry)
+		valid += int64(len(header) + len(data))
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return
+}
+
+func (b *LogBackend) apply(entry *logEntry) {
+	key := entry.Record.Domain + "\x00" + entry.Record.Type
+	if entry.Removed {
+		delete(b.records, key)
+	} else {
+		b.records[key] = entry.Record
+	}
+	b.entries++
+}
+
+// Load returns the records in the log.
+func (b *LogBackend) Load() (ret []StoredRecord, err error) {
+	for _, record := range b.records {
+		ret = append(ret, record)
+	}
+	return
+}
+
+// Save appends a record to the log.
+func (b *LogBackend) Save(record StoredRecord) error {
+	return b.append(&logEntry{Record: record})
+}
+
+// Delete appends the removal of a record to the log.
+func (b *LogBackend) Delete(domain string, typ string) error {
+	if _, ok := b.records[domain+"\x00"+typ]; !ok {
+		return nil
+	}
+	return b.append(&logEntry{Record: StoredRecord{Domain: domain, Type: typ}, Removed: true})
+}
+
+// Close closes the log file.
+func (b *LogBackend) Close() (err error) {
+	if b.file != nil {
+		err = b.file.Close()
+		b.file = nil
+	}
+	return
+}
+
+// append writes an entry to the end of the log and syncs it, compacting the
+// log if it has grown mostly stale.
+func (b *LogBackend) append(entry *logEntry) (err error) {
+	if b.file == nil {
+		return errLogClosed
+	}
+	if err = writeLogEntry(b.file, entry); err == nil {
+		err = b.file.Sync()
+	}
+	if err != nil {
+		return
+	}
+	b.apply(entry)
+	if b.entries >= logCompactMin && b.entries > 2*len(b.records) {
+		err = b.compact()
+	}
+	return
+}
+
+// compact replaces the log with one holding only the live records.
+func (b *LogBackend) compact() (err error) {
+	temp := b.path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	writer := bufio.NewWriter(file)
+	for _, record := range b.records {
+		if err = writeLogEntry(writer, &logEntry{Record: record}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(temp, b.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(temp)
+		return
+	}
+
+	// Make the rename itself durable before dropping the old log
+	if dir, err := os.Open(filepath.Dir(b.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	b.file.Close()
+	b.file = file
+	b.entries = len(b.records)
+	return
+}
+
+// writeLogEntry writes an entry framed by its length and checksum.
+func writeLogEntry(w io.Writer, entry *logEntry) error {
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(entry); err != nil {
+		return err
+	}
+	header := binary.BigEndian.AppendUint32(nil, uint32(data.Len()))
+	header = binary.BigEndian.AppendUint32(header, crc32.ChecksumIEEE(data.Bytes()))
+	_, err := w.Write(append(header, data.Bytes()...))
+	return err
+}
@@ -0,0 +1,126 @@
+package kademlia
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.log")
+	b, err := OpenLogBackend(path)
+	if err != nil {
+		t.Fatalf("Error opening log: %s", err)
+	}
+	set := signed("www.google.com", "A", Record{IP: net.ParseIP("74.125.224.72"), TTL: DefaultTTL})
+	expires := time.Now().Add(time.Hour).Round(0)
+	b.Save(StoredRecord{"www.google.com", "A", set, expires, expires, false})
+	b.Save(StoredRecord{"example.com", "A", set, time.Time{}, expires, true})
+	b.Save(StoredRecord{"example.com", "TXT", set, time.Time{}, expires, true})
+	b.Delete("example.com", "TXT")
+	b.Close()
+	if err := b.Save(StoredRecord{Domain: "example.org", Type: "A"}); err != errLogClosed {
+		t.Errorf("Expected errLogClosed saving to a closed log, received %v", err)
+	}
+
+	// A crash part way through writing an entry leaves a torn tail
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+	file.Close()
+
+	if b, err = OpenLogBackend(path); err != nil {
+		t.Fatalf("Error reopening log: %s", err)
+	}
+	defer b.Close()
+	records, _ := b.Load()
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records after reopening, found %v", records)
+	}
+	for _, r := range records {
+		if r.Domain == "www.google.com" && (!r.Expires.Equal(expires) || r.Published || !onlyIP(r.Set.Records).Equal(net.ParseIP("74.125.224.72"))) {
+			t.Errorf("Expected www.google.com to be restored as saved, found %+v", r)
+		}
+		if r.Domain == "example.com" && (r.Type != "A" || !r.Published) {
+			t.Errorf("Expected only published A records for example.com, found %+v", r)
+		}
+	}
+
+	// The torn entry is dropped, so new entries are readable after it
+	if err := b.Save(StoredRecord{"example.org", "A", set, expires, expires, false}); err != nil {
+		t.Fatalf("Error saving after recovery: %s", err)
+	}
+	reopened, err := OpenLogBackend(path)
+	if err != nil {
+		t.Fatalf("Error reopening log: %s", err)
+	}
+	defer reopened.Close()
+	if records, _ := reopened.Load(); len(records) != 3 {
+		t.Errorf("Expected 3 records after saving past a torn entry, found %d", len(records))
+	}
+}
+
+func TestLogBackendCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.log")
+	b, err := OpenLogBackend(path)
+	if err != nil {
+		t.Fatalf("Error opening log: %s", err)
+	}
+	defer b.Close()
+
+	set := signed("www.google.com", "A", Record{IP: net.ParseIP("74.125.224.72"), TTL: DefaultTTL})
+	for i := 0; i < logCompactMin; i++ {
+		if err := b.Save(StoredRecord{"www.google.com", "A", set, time.Time{}, time.Now(), true}); err != nil {
+			t.Fatalf("Error saving entry %d: %s", i, err)
+		}
+	}
+	if b.entries != 1 {
+		t.Errorf("Expected the log to be compacted to 1 entry, found %d", b.entries)
+	}
+	b.Save(StoredRecord{"example.com", "A", set, time.Time{}, time.Now(), true})
+
+	reopened, err := OpenLogBackend(path)
+	if err != nil {
+		t.Fatalf("Error reopening log: %s", err)
+	}
+	defer reopened.Close()
+	if records, _ := reopened.Load(); len(records) != 2 {
+		t.Errorf("Expected 2 records after compaction, found %d", len(records))
+	}
+}
+
+func TestDomainStoreBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.log")
+	b, err := OpenLogBackend(path)
+	if err != nil {
+		t.Fatalf("Error opening log: %s", err)
+	}
+	d := NewDomainStore()
+	d.open(b)
+	ip := net.ParseIP("74.125.224.72")
+	d.storeRecord("www.google.com", "A", signed("www.google.com", "A", Record{IP: ip, TTL: DefaultTTL}), time.Hour)
+	d.publishRecord("example.com", "A", signed("example.com", "A", Record{IP: ip, TTL: DefaultTTL}))
+	d.storeRecord("example.org", "A", signed("example.org", "A", Record{IP: ip, TTL: DefaultTTL}), time.Minute)
+	d.expire(time.Now().Add(2 * time.Minute))
+	b.Close()
+
+	// A restarted node holds the same records, with the same timers
+	if b, err = OpenLogBackend(path); err != nil {
+		t.Fatalf("Error reopening log: %s", err)
+	}
+	defer b.Close()
+	restarted := NewDomainStore()
+	if err := restarted.open(b); err != nil {
+		t.Fatalf("Error loading records: %s", err)
+	}
+	if ret := restarted.retrieve("www.google.com", "A").Records; !onlyIP(ret).Equal(ip) {
+		t.Errorf("Expected replica %s to survive a restart, received %v", ip, ret)
+	}
+	if record := restarted.data["example.com"]["A"]; record == nil || !record.published || !record.expires.IsZero() {
+		t.Errorf("Expected example.com to remain published after a restart, found %+v", record)
+	}
+	if ret := restarted.retrieve("example.org", "A"); !ret.empty() {
+		t.Errorf("Expected expired record to stay deleted, found %v", ret)
+	}
+}
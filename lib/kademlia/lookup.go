@@ -0,0 +1,275 @@
+package kademlia
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// lookupState is how far an iterative lookup has got with a contact.
+type lookupState int
+
+const (
+	unqueried lookupState = iota // not sent a query yet
+	queried                      // sent a query that has not been answered
+	responded                    // answered its query
+	failed                       // did not answer its query
+	claimed                      // queried by another of the lookup's paths
+)
+
+// lookupQuery sends one query of an iterative lookup to a contact, returning
+// the contacts it knows of closest to the lookup's target.
+type lookupQuery func(ctx context.Context, contact *Contact) ([]Contact, error)
+
+// lookupReply is the outcome of one query sent during an iterative lookup.
+type lookupReply struct {
+	contact  *Contact
+	contacts []Contact
+	err      error
+}
+
+// lookup looks for the bucketSize nodes closest to target, sending query to
+// delta at a time of the closest it knows of on each of DisjointPaths paths.
+// A path ends once the closest contacts on it that have not failed have all
+// responded, enough reports true, or the lookup's deadline passes.  Once a
+// reply brings no closer node, the rest of the closest on its path are
+// queried at once.  It returns the closest nodes that responded, taken from
+// every path in turn, and every node queried.
+func (k *Kademlia) lookup(ctx context.Context, target NodeID, delta int, query lookupQuery, enough func() bool) (closest contactRecList, queried contactRecList) {
+	ctx, cancel := context.WithTimeout(ctx, k.LookupTimeout)
+	defer cancel()
+	k.routes.touch(target)
+
+	paths := k.DisjointPaths
+	if paths < 1 {
+		paths = 1
+	}
+	claims := newClaimSet()
+	lists := make([]*shortlist, paths)
+	for i := range lists {
+		lists[i] = newShortlist(target, k.routes.node.id, claims, i)
+	}
+	// The closest contacts we know of are dealt out among the paths, each
+	// keeping its own even if another path learns of them first
+	for i, record := range k.routes.findClosest(target, bucketSize) {
+		lists[i%paths].add(*record.node)
+		claims.claim(record.node.id, i%paths)
+	}
+
+	var wg sync.WaitGroup
+	for _, list := range lists {
+		wg.Add(1)
+		go func(list *shortlist) {
+			defer wg.Done()
+			k.walk(ctx, list, delta, query, enough)
+		}(list)
+	}
+	wg.Wait()
+
+	// Each path has an equal share of the result, so one led astray by
+	// hostile nodes cannot crowd out the closer nodes others found
+	results := make([]contactRecList, paths)
+	for i, list := range lists {
+		results[i] = list.closest(bucketSize)
+		queried = append(queried, list.queried()...)
+	}
+	for i := 0; len(closest) < bucketSize; i++ {
+		added := false
+		for _, result := range results {
+			if i < len(result) && len(closest) < bucketSize {
+				closest = append(closest, result[i])
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	sort.Sort(closest)
+	return
+}
+
+// walk follows one path of a lookup.
+func (k *Kademlia) walk(ctx context.Context, list *shortlist, delta int, query lookupQuery, enough func() bool) {
+	// Queries still outstanding when the path ends are cancelled with the
+	// lookup, and their replies left in the channel
+	done := make(chan lookupReply, bucketSize)
+	pending, parallelism := 0, delta
+	for !list.done() && (enough == nil || !enough()) {
+		for pending < parallelism && ctx.Err() == nil {
+			record := list.next()
+			if record == nil {
+				break
+			}
+			pending++
+			go func(contact *Contact) {
+				contacts, err := query(ctx, contact)
+				done <- lookupReply{contact, contacts, err}
+			}(record.node)
+		}
+		if pending == 0 {
+			break
+		}
+
+		reply := <-done
+		pending--
+		if reply.err != nil {
+			list.mark(reply.contact.id, failed)
+			continue
+		}
+		list.mark(reply.contact.id, responded)
+		if list.add(k.verified(reply.contacts)...) {
+			parallelism = delta
+		} else {
+			parallelism = bucketSize
+		}
+	}
+}
+
+// verified returns the contacts whose ids are derived from their keys and
+// solve the network's puzzle, leaving out any a hostile node made up to lead
+// the lookup astray.
+func (k *Kademlia) verified(contacts []Contact) (ret []Contact) {
+	for i := range contacts {
+		if verifyContact(&contacts[i], k.NodeDifficulty) == nil {
+			ret = append(ret, contacts[i])
+		}
+	}
+	return
+}
+
+// claimSet records which path of a lookup queried each node, so that no two
+// paths query the same one.
+type claimSet struct {
+	mutex sync.Mutex
+	paths map[NodeID]int
+}
+
+func newClaimSet() *claimSet {
+	return &claimSet{paths: make(map[NodeID]int)}
+}
+
+// claim reserves a node for a path, reporting false if another path already
+// has it.
+func (claims *claimSet) claim(id NodeID, path int) bool {
+	claims.mutex.Lock()
+	defer claims.mutex.Unlock()
+	if owner, ok := claims.paths[id]; ok {
+		return owner == path
+	}
+	claims.paths[id] = path
+	return true
+}
+
+// shortlist holds the contacts one path of an iterative lookup has learned
+// of, closest to its target first, and how far the path has got with each.
+// Only the bucketSize closest contacts that have not failed or been claimed
+// by another path are ever queried, and the path is over once all of those
+// have responded.
+type shortlist struct {
+	target   NodeID
+	contacts contactRecList
+	state    map[NodeID]lookupState
+	claims   *claimSet
+	path     int
+}
+
+// newShortlist creates an empty shortlist for a path of a lookup of target,
+// which never includes self.
+func newShortlist(target NodeID, self NodeID, claims *claimSet, path int) *shortlist {
+	return &shortlist{target: target, state: map[NodeID]lookupState{self: failed}, claims: claims, path: path}
+}
+
+// add adds contacts not seen before, reporting whether any of them is closer
+// to the target than every contact already in the shortlist.
+func (list *shortlist) add(contacts ...Contact) (closer bool) {
+	for i := range contacts {
+		contact := contacts[i]
+		if _, ok := list.state[contact.id]; ok {
+			continue
+		}
+		record := &ContactRecord{&contact, contact.id.Xor(list.target)}
+		closer = closer || len(list.contacts) == 0 || record.Less(list.contacts[0])
+		list.contacts = append(list.contacts, record)
+		list.state[contact.id] = unqueried
+	}
+	sort.Sort(list.contacts)
+	return
+}
+
+// next marks the closest contact not yet queried as queried and returns it,
+// or nil if every one of the bucketSize closest has been queried already.
+func (list *shortlist) next() *ContactRecord {
+	candidates := 0
+	for _, record := range list.contacts {
+		switch list.state[record.node.id] {
+		case failed, claimed:
+			continue
+		case unqueried:
+			if !list.claims.claim(record.node.id, list.path) {
+				list.state[record.node.id] = claimed
+				continue
+			}
+			list.state[record.node.id] = queried
+			return record
+		}
+		if candidates++; candidates == bucketSize {
+			break
+		}
+	}
+	return nil
+}
+
+// mark records the outcome of querying a contact.
+func (list *shortlist) mark(id NodeID, state lookupState) {
+	list.state[id] = state
+}
+
+// done reports whether the bucketSize closest contacts left to the path have
+// all responded.
+func (list *shortlist) done() bool {
+	return len(list.closest(bucketSize)) == list.live(bucketSize)
+}
+
+// live counts the contacts left to the path, those that have not failed or
+// been claimed by another, up to count.
+func (list *shortlist) live(count int) (ret int) {
+	for _, record := range list.contacts {
+		if ret == count {
+			break
+		}
+		if state := list.state[record.node.id]; state != failed && state != claimed {
+			ret++
+		}
+	}
+	return
+}
+
+// closest returns the contacts that have responded from among the count
+// closest left to the path.
+func (list *shortlist) closest(count int) (ret contactRecList) {
+	live := 0
+	for _, record := range list.contacts {
+		if live == count {
+			break
+		}
+		switch list.state[record.node.id] {
+		case failed, claimed:
+			continue
+		case responded:
+			ret = append(ret, record)
+		}
+		live++
+	}
+	return
+}
+
+// queried returns the contacts the path sent a query.
+func (list *shortlist) queried() (ret contactRecList) {
+	for _, record := range list.contacts {
+		if state := list.state[record.node.id]; state != unqueried && state != claimed {
+			ret = append(ret, record)
+		}
+	}
+	return
+}
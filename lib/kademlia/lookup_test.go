@@ -0,0 +1,203 @@
+package kademlia
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestShortlist(t *testing.T) {
+	var target, self NodeID
+	list := newShortlist(target, self, newClaimSet(), 0)
+
+	// Contacts at distance 1 to bucketSize+1 from the target, added out of order
+	var contacts []Contact
+	for i := bucketSize; i >= 0; i-- {
+		var id NodeID
+		id[idLength-1] = byte(i + 1)
+		contacts = append(contacts, Contact{id: id, address: "node"})
+	}
+	if !list.add(contacts...) {
+		t.Errorf("Expected the first contacts to be closer")
+	}
+	if list.add(Contact{id: self, address: "self"}, contacts[0]) || len(list.contacts) != bucketSize+1 {
+		t.Errorf("Expected self and known contacts to be ignored, found %d contacts", len(list.contacts))
+	}
+
+	// Contacts are queried closest first, and only from the closest bucketSize
+	for i := 0; i < bucketSize; i++ {
+		record := list.next()
+		if record == nil || record.node.id[idLength-1] != byte(i+1) {
+			t.Fatalf("Expected contact %d to be queried next, found %v", i+1, record)
+		}
+	}
+	if record := list.next(); record != nil {
+		t.Errorf("Expected only the closest %d contacts to be queried, found %s", bucketSize, record.node)
+	}
+
+	// A failure lets the next closest contact in
+	list.mark(list.contacts[0].node.id, failed)
+	if record := list.next(); record == nil || record.node.id[idLength-1] != byte(bucketSize+1) {
+		t.Errorf("Expected contact %d to replace the failed one, found %v", bucketSize+1, record)
+	}
+	for _, record := range list.contacts[1:] {
+		if list.done() {
+			t.Fatalf("Expected lookup to go on until every contact responds")
+		}
+		list.mark(record.node.id, responded)
+	}
+	if !list.done() {
+		t.Errorf("Expected lookup to be done once the closest %d responded", bucketSize)
+	}
+	closest := list.closest(bucketSize)
+	if len(closest) != bucketSize || closest[0] != list.contacts[1] {
+		t.Errorf("Expected the closest %d contacts that responded, found %d", bucketSize, len(closest))
+	}
+}
+
+func TestShortlistClaims(t *testing.T) {
+	var target, self NodeID
+	claims := newClaimSet()
+	first, second := newShortlist(target, self, claims, 0), newShortlist(target, self, claims, 1)
+
+	// A contact known to both paths is only queried by the first to reach it
+	var near, far NodeID
+	near[idLength-1], far[idLength-1] = 1, 2
+	first.add(Contact{id: near, address: "near"})
+	second.add(Contact{id: near, address: "near"}, Contact{id: far, address: "far"})
+	if record := first.next(); record == nil || !record.node.id.Equals(near) {
+		t.Fatalf("Expected the first path to query %s, found %v", near, record)
+	}
+	if record := second.next(); record == nil || !record.node.id.Equals(far) {
+		t.Fatalf("Expected the second path to skip %s for %s, found %v", near, far, record)
+	}
+	second.mark(far, responded)
+	if !second.done() || len(second.closest(bucketSize)) != 1 || len(second.queried()) != 1 {
+		t.Errorf("Expected the second path to end with only %s, found %d queried", far, len(second.queried()))
+	}
+}
+
+// countingTransport counts the calls made through it by method.
+type countingTransport struct {
+	Transport
+	mutex sync.Mutex
+	calls map[string]int
+}
+
+func (t *countingTransport) Call(ctx context.Context, address string, method string, args, reply interface{}) error {
+	t.mutex.Lock()
+	t.calls[method]++
+	t.mutex.Unlock()
+	return t.Transport.Call(ctx, address, method, args, reply)
+}
+
+func TestSimLookupStops(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newSimNodes(t, network, 100)
+	defer closeSimNodes(nodes)
+
+	// A lookup ends once the closest nodes have answered, rather than
+	// going on to query most of the network
+	k := nodes[len(nodes)-1]
+	counter := &countingTransport{Transport: k.Transport, calls: make(map[string]int)}
+	k.Transport = counter
+	for i := 0; i < 10; i++ {
+		if found := k.iterativeFindNode(context.Background(), NewRandomNodeID(), alpha); len(found) != bucketSize {
+			t.Errorf("Lookup %d expected %d contacts, found %d", i, bucketSize, len(found))
+		}
+	}
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	if queries := counter.calls["kademliaCore.FindNode"]; queries > 10*2*bucketSize {
+		t.Errorf("Expected at most %d queries for 10 lookups, found %d", 10*2*bucketSize, queries)
+	}
+}
+
+// sybilHandler answers FIND_NODE with fabricated contacts, all of them its
+// fellow sybils, instead of the nodes it really knows.
+type sybilHandler struct {
+	kademliaCore
+	sybils []Contact
+}
+
+func (h *sybilHandler) FindNode(args *FindNodeRequest, response *FindNodeResponse) (err error) {
+	if err = h.kad.handleRPC(&args.RPCHeader, &response.RPCHeader); err == nil {
+		response.Contacts = h.sybils
+	}
+	return
+}
+
+func TestSimDisjointPaths(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newSimNodes(t, network, 60)
+	defer closeSimNodes(nodes)
+	target := NewRandomNodeID()
+
+	// Ids come from keys, so sybils posing as the nodes closest to the
+	// target must search for keys whose ids share a long prefix with it.
+	// The puzzle is left out so that the search only pays for the prefix.
+	for _, k := range nodes {
+		k.NodeDifficulty = 0
+	}
+	near := func(address string) *Kademlia {
+		for {
+			key, err := NewNodeKey(0)
+			if err != nil {
+				t.Fatalf("Error generating key: %s", err)
+			}
+			if NodeIDFromKey(key.Public().(ed25519.PublicKey)).Xor(target).PrefixLen() >= 10 {
+				k := NewKademlia(key, address, "test")
+				k.NodeDifficulty = 0
+				k.Transport = network.NewTransport()
+				return k
+			}
+		}
+	}
+	var sybils []Contact
+	var sybilNodes []*Kademlia
+	for i := 0; i < bucketSize; i++ {
+		sybilNodes = append(sybilNodes, near(fmt.Sprintf("sybil%d", i)))
+		sybils = append(sybils, sybilNodes[i].routes.node)
+	}
+	for _, sybil := range sybilNodes {
+		if err := sybil.Transport.Listen(sybil.routes.node.address, &sybilHandler{kademliaCore{sybil}, sybils}); err != nil {
+			t.Fatalf("Error listening on %s: %s", sybil.routes.node.address, err)
+		}
+	}
+
+	// A hostile node that has joined the network near the target leads
+	// lookups to the sybils
+	hostile := near("hostile")
+	if err := hostile.Join(context.Background(), nodes[0].routes.node); err != nil {
+		t.Fatalf("Error joining hostile node: %s", err)
+	}
+	defer hostile.Close()
+	network.handlers["hostile"] = &sybilHandler{kademliaCore{hostile}, sybils}
+
+	honest := func(found contactRecList) (ret int) {
+		for _, record := range found {
+			if !strings.HasPrefix(record.node.address, "sybil") {
+				ret++
+			}
+		}
+		return
+	}
+	// Only the path the hostile node is on reaches them.  Every node that
+	// hears from the sybils keeps them in its routing table, so the next
+	// lookup is made from another node.
+	k := nodes[len(nodes)-1]
+	k.routes.insert(&hostile.routes.node)
+	k.DisjointPaths = 3
+	if found := k.iterativeFindNode(context.Background(), target, alpha); honest(found) < bucketSize/2 {
+		t.Errorf("Expected most nodes found over disjoint paths to be honest, found %d of %d", honest(found), len(found))
+	}
+
+	k = nodes[len(nodes)-2]
+	k.routes.insert(&hostile.routes.node)
+	if found := k.iterativeFindNode(context.Background(), target, alpha); honest(found) >= bucketSize/2 {
+		t.Errorf("Expected a plain lookup to be led to the sybils, found %d honest nodes", honest(found))
+	}
+}
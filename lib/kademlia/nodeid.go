@@ -1,8 +1,11 @@
 package kademlia
 
 import (
+	"crypto/rand"
+	"crypto/sha1"
 	"encoding/hex"
-	"math/rand"
+	"hash"
+	"strings"
 )
 
 const idLength = 20
@@ -23,14 +26,40 @@ func NewNodeID(data string) (ret NodeID) {
 	return
 }
 
-// NewRandomNodeID creates a new random node ID
+// NewRandomNodeID creates a new random node ID, for use as a lookup target.
+// The ids of nodes themselves come from their keys; see NodeIDFromKey.
 func NewRandomNodeID() (ret NodeID) {
-	for i := 0; i < idLength; i++ {
-		ret[i] = uint8(rand.Intn(256))
-	}
+	rand.Read(ret[:])
 	return
 }
 
+// DomainKey returns the DHT key for a domain record, the SHA-1 hash of the
+// normalized domain name and record type.
+func DomainKey(domain string, typ string) NodeID {
+	return HashDomainKey(sha1.New, domain, typ)
+}
+
+// HashDomainKey returns the DHT key for a domain record using the given hash,
+// which must produce at least idLength bytes.
+func HashDomainKey(h func() hash.Hash, domain string, typ string) (ret NodeID) {
+	hasher := h()
+	hasher.Write([]byte(normalizeDomain(domain)))
+	hasher.Write([]byte{0}) // not valid in a domain name, so pairs cannot collide
+	hasher.Write([]byte(normalizeType(typ)))
+	copy(ret[:], hasher.Sum(nil))
+	return
+}
+
+// normalizeDomain lowercases a domain name and strips surrounding space and
+// the trailing root dot, so equivalent spellings share a key.
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+func normalizeType(typ string) string {
+	return strings.ToUpper(strings.TrimSpace(typ))
+}
+
 func (node NodeID) String() string {
 	return hex.EncodeToString(node[0:idLength])
 }
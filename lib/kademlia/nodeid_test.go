@@ -1,6 +1,9 @@
 package kademlia
 
 import (
+  "bytes"
+  "crypto/sha1"
+  "crypto/sha256"
   "testing"
   "fmt"
   "strings"
@@ -50,3 +53,30 @@ func TestNodeID(t *testing.T) {
       rightPad2Len(domain_node, "0", 40), NewNodeID(domain_node).String());
   }
 }
+
+func TestDomainKey(t *testing.T) {
+  a := DomainKey("www.google.com", "A")
+  if !a.Equals(DomainKey(" WWW.Google.COM. ", "a")) {
+    t.Errorf("Expected equivalent domain spellings to share key %s", a)
+  }
+  if a.Equals(DomainKey("www.google.com", "AAAA")) {
+    t.Errorf("Expected record types to have different keys")
+  }
+
+  expected := sha1.Sum([]byte("www.google.com\x00A"))
+  if !a.Equals(NodeID(expected)) {
+    t.Errorf("Expected SHA-1 key %x: obtained %s", expected, a)
+  }
+
+  // Names sharing their first idLength characters used to collide
+  long := "averyveryverylongsubdomain"
+  if DomainKey(long + ".example.com", "A").Equals(DomainKey(long + ".example.org", "A")) {
+    t.Errorf("Expected long domains sharing a prefix to have different keys")
+  }
+
+  wide := HashDomainKey(sha256.New, "www.google.com", "A")
+  full := sha256.Sum256([]byte("www.google.com\x00A"))
+  if !bytes.Equal(wide[:], full[:idLength]) {
+    t.Errorf("Expected truncated SHA-256 key %x: obtained %s", full[:idLength], wide)
+  }
+}
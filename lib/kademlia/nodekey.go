@@ -0,0 +1,63 @@
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"crypto/sha1"
+	"fmt"
+	"math/bits"
+)
+
+// DefaultNodeDifficulty is the number of leading zero bits the static puzzle
+// on a node id needs unless the network is configured otherwise.
+const DefaultNodeDifficulty = 16
+
+// NewNodeKey generates a key for a node whose id solves the static puzzle with
+// at least difficulty leading zero bits.  As in S/Kademlia, a node's id is
+// the hash of its public key, so it cannot pick where in the keyspace it
+// sits, and each id costs about 2^difficulty keys to find.
+func NewNodeKey(difficulty int) (ed25519.PrivateKey, error) {
+	for {
+		public, private, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return nil, err
+		}
+		if nodeWork(NodeIDFromKey(public)) >= difficulty {
+			return private, nil
+		}
+	}
+}
+
+// NodeIDFromKey returns the id of the node holding a key, the SHA-1 hash of
+// its public key.
+func NodeIDFromKey(key ed25519.PublicKey) (ret NodeID) {
+	sum := sha1.Sum(key)
+	copy(ret[:], sum[:])
+	return
+}
+
+// nodeWork returns the number of leading zero bits in the hash of a node id,
+// the static puzzle its key must solve.
+func nodeWork(id NodeID) (work int) {
+	for _, b := range sha1.Sum(id[:]) {
+		work += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return
+}
+
+// verifyContact checks that a contact's id is derived from its key and solves
+// the static puzzle with at least difficulty leading zero bits.
+func verifyContact(contact *Contact, difficulty int) error {
+	if len(contact.key) != ed25519.PublicKeySize {
+		return fmt.Errorf("Contact %s has no key", contact)
+	}
+	if !NodeIDFromKey(contact.key).Equals(contact.id) {
+		return fmt.Errorf("Contact %s does not match its key", contact)
+	}
+	if nodeWork(contact.id) < difficulty {
+		return fmt.Errorf("Contact %s has insufficient work in its id", contact)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+// testNodeDifficulty keeps node key generation in tests quick
+const testNodeDifficulty = 4
+
+func TestNodeKey(t *testing.T) {
+	key, err := NewNodeKey(testNodeDifficulty)
+	if err != nil {
+		t.Fatalf("Error generating node key: %s", err)
+	}
+	contact := newKeyedContact(key.Public().(ed25519.PublicKey), "localhost:8000")
+	if err := verifyContact(&contact, testNodeDifficulty); err != nil {
+		t.Errorf("Expected a new node key to verify: %s", err)
+	}
+	if nodeWork(contact.id) >= 64 || verifyContact(&contact, 64) == nil {
+		t.Errorf("Expected a contact to fail a puzzle harder than its key solves")
+	}
+
+	// A contact must hold the key its id is derived from
+	chosen := contact
+	chosen.id = NewRandomNodeID()
+	if err := verifyContact(&chosen, 0); err == nil {
+		t.Errorf("Expected error for a contact whose id does not match its key")
+	}
+	unkeyed := NewContact(contact.id, contact.address)
+	if err := verifyContact(&unkeyed, 0); err == nil {
+		t.Errorf("Expected error for a contact without a key")
+	}
+}
@@ -0,0 +1,251 @@
+package kademlia
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultTTL is the time to live given to records published without one.
+const DefaultTTL = 5 * time.Minute
+
+// Record is one resource record in the set held for a domain and type.  Only
+// the fields used by the record's type are set.  TTL is how long resolvers
+// may cache it, not how long the DHT keeps it.
+type Record struct {
+	TTL        time.Duration
+	IP         net.IP    // A and AAAA
+	Host       string    // CNAME, NS, MX exchange and SRV target
+	Priority   uint16    // MX preference and SRV priority
+	Weight     uint16    // SRV
+	Port       uint16    // SRV
+	Text       []string  // TXT
+	Flags      uint8     // CAA
+	Tag        string    // CAA
+	Value      string    // CAA
+	Registered time.Time // REGISTRATION, when the owner signed the claim
+	Expires    time.Time // REGISTRATION
+	Nonce      uint64    // REGISTRATION
+}
+
+// RecordSet is the set of records for a domain and type, signed by the key
+// that owns the domain.  Each new version of a set has a higher sequence
+// number than the last, so replicas can tell which is newest.  A deleted set
+// is replaced by a tombstone: a version with no records.
+type RecordSet struct {
+	Records   []Record
+	Sequence  uint64
+	Deleted   bool
+	Owner     ed25519.PublicKey
+	Signature []byte
+}
+
+// recordTypes are the types of record set that owners publish and delete.
+var recordTypes = []string{"A", "AAAA", "CNAME", "NS", "MX", "TXT", "SRV", "CAA"}
+
+// ErrBadSignature is returned for record sets not signed by their owner.
+var ErrBadSignature = errors.New("Invalid record set signature")
+
+// ErrNotOwner is returned for record sets signed by a key other than the one
+// that already owns the domain.
+var ErrNotOwner = errors.New("Record set is owned by another key")
+
+// ErrStaleRecord is returned for record sets older than the one already held.
+var ErrStaleRecord = errors.New("Record set is older than the one held")
+
+// SignRecords signs a version of the record set for a domain and type with its
+// owner's key.
+func SignRecords(key ed25519.PrivateKey, domain string, typ string, sequence uint64, records []Record) RecordSet {
+	return RecordSet{
+		Records:   records,
+		Sequence:  sequence,
+		Owner:     key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(key, signedData(domain, typ, sequence, records)),
+	}
+}
+
+// SignTombstone signs a tombstone deleting the record set for a domain and
+// type as of the given version.  The signature covers an empty set, which is
+// only valid as a tombstone.
+func SignTombstone(key ed25519.PrivateKey, domain string, typ string, sequence uint64) RecordSet {
+	set := SignRecords(key, domain, typ, sequence, nil)
+	set.Deleted = true
+	return set
+}
+
+// empty reports whether the set holds neither records nor a tombstone, as
+// when nothing is held for a domain and type.
+func (s *RecordSet) empty() bool {
+	return len(s.Records) == 0 && !s.Deleted
+}
+
+// nextSequence returns the sequence number for a set replacing the version
+// numbered previous: the current time in nanoseconds, so that owners need not
+// remember their last version, unless the clock has gone backwards.
+func nextSequence(previous uint64) uint64 {
+	if now := uint64(time.Now().UnixNano()); now > previous {
+		return now
+	}
+	return previous + 1
+}
+
+// supersedes reports whether the set is a newer version than other.  Sets
+// with the same sequence number are ordered by signature so that every
+// replica settles on the same one.
+func (s *RecordSet) supersedes(other *RecordSet) bool {
+	if s.Sequence != other.Sequence {
+		return s.Sequence > other.Sequence
+	}
+	return bytes.Compare(s.Signature, other.Signature) > 0
+}
+
+// elect returns the newest of the sets from the owner that signed the most of
+// them, with ties going to the owner found first.
+func elect(sets []RecordSet) (set RecordSet) {
+	votes := make(map[string]int)
+	for _, s := range sets {
+		votes[string(s.Owner)]++
+	}
+	best := 0
+	for _, s := range sets {
+		if n := votes[string(s.Owner)]; n > best {
+			set, best = s, n
+		} else if s.Owner.Equal(set.Owner) && s.supersedes(&set) {
+			set = s
+		}
+	}
+	return
+}
+
+// Verify checks that the set holds valid records for the domain and type,
+// signed by its owner.
+func (s *RecordSet) Verify(domain string, typ string) error {
+	if s.Deleted {
+		if len(s.Records) > 0 || !deletable(typ) {
+			return fmt.Errorf("Invalid %s tombstone for %s", typ, domain)
+		}
+	} else if err := validateRecords(typ, s.Records); err != nil {
+		return err
+	}
+	if len(s.Owner) != ed25519.PublicKeySize || !ed25519.Verify(s.Owner, signedData(domain, typ, s.Sequence, s.Records), s.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// signedData encodes a version of the records for a domain and type
+// unambiguously, as the message their owner signs.
+func signedData(domain string, typ string, sequence uint64, records []Record) []byte {
+	data := []byte("dominion records\x00")
+	data = appendField(data, []byte(normalizeDomain(domain)))
+	data = appendField(data, []byte(normalizeType(typ)))
+	data = binary.BigEndian.AppendUint64(data, sequence)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(records)))
+	for _, r := range records {
+		data = binary.BigEndian.AppendUint64(data, uint64(r.TTL))
+		data = appendField(data, r.IP.To16())
+		data = appendField(data, []byte(r.Host))
+		data = binary.BigEndian.AppendUint16(data, r.Priority)
+		data = binary.BigEndian.AppendUint16(data, r.Weight)
+		data = binary.BigEndian.AppendUint16(data, r.Port)
+		data = binary.BigEndian.AppendUint32(data, uint32(len(r.Text)))
+		for _, text := range r.Text {
+			data = appendField(data, []byte(text))
+		}
+		data = append(data, r.Flags)
+		data = appendField(data, []byte(r.Tag))
+		data = appendField(data, []byte(r.Value))
+		data = binary.BigEndian.AppendUint64(data, uint64(r.Registered.Unix()))
+		data = binary.BigEndian.AppendUint64(data, uint64(r.Expires.Unix()))
+		data = binary.BigEndian.AppendUint64(data, r.Nonce)
+	}
+	return data
+}
+
+// appendField appends a length-prefixed field.
+func appendField(data []byte, field []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(data, uint32(len(field))), field...)
+}
+
+// validate checks that the record has the data its type needs.
+func (r *Record) validate(typ string) (err error) {
+	var ok bool
+	switch normalizeType(typ) {
+	case "A":
+		ok = r.IP.To4() != nil
+	case "AAAA":
+		ok = len(r.IP) == net.IPv6len && r.IP.To4() == nil
+	case "CNAME", "NS", "MX", "SRV":
+		ok = r.Host != ""
+	case "TXT":
+		ok = len(r.Text) > 0
+	case "CAA":
+		ok = r.Tag != ""
+	case RegistrationType:
+		ok = !r.Registered.IsZero() && r.Registered.Before(r.Expires)
+	default:
+		return fmt.Errorf("Unsupported record type %s", typ)
+	}
+	if !ok || r.TTL < 0 {
+		err = fmt.Errorf("Invalid %s record %+v", typ, *r)
+	}
+	return
+}
+
+// deletable reports whether sets of the type can be replaced by tombstones.
+func deletable(typ string) bool {
+	for _, t := range recordTypes {
+		if normalizeType(typ) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRecords checks a record set before it is stored.
+func validateRecords(typ string, records []Record) error {
+	if len(records) == 0 {
+		return fmt.Errorf("Empty %s record set", typ)
+	}
+	if t := normalizeType(typ); (t == "CNAME" || t == RegistrationType) && len(records) > 1 {
+		return fmt.Errorf("A name can only have one %s record, found %d", t, len(records))
+	}
+	for i := range records {
+		if err := records[i].validate(typ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Record) equal(other *Record) bool {
+	if !r.IP.Equal(other.IP) || len(r.Text) != len(other.Text) {
+		return false
+	}
+	for i := range r.Text {
+		if r.Text[i] != other.Text[i] {
+			return false
+		}
+	}
+	return r.TTL == other.TTL && r.Host == other.Host && r.Priority == other.Priority &&
+		r.Weight == other.Weight && r.Port == other.Port && r.Flags == other.Flags &&
+		r.Tag == other.Tag && r.Value == other.Value && r.Registered.Equal(other.Registered) &&
+		r.Expires.Equal(other.Expires) && r.Nonce == other.Nonce
+}
+
+// sameRecords reports whether two record sets hold the same records in the same order.
+func sameRecords(a, b []Record) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].equal(&b[i]) {
+			return false
+		}
+	}
+	return true
+}
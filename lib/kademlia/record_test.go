@@ -0,0 +1,93 @@
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+)
+
+// testKey owns the records published in tests
+var testKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+// signed signs a new version of the records for a domain and type with
+// testKey.
+func signed(domain string, typ string, records ...Record) RecordSet {
+	return SignRecords(testKey, domain, typ, nextSequence(0), records)
+}
+
+func TestValidateRecords(t *testing.T) {
+	valid := map[string][]Record{
+		"A":     {{IP: net.ParseIP("93.184.216.34")}},
+		"AAAA":  {{IP: net.ParseIP("2606:2800:220:1::1")}},
+		"CNAME": {{Host: "example.com"}},
+		"NS":    {{Host: "ns1.example.com"}, {Host: "ns2.example.com"}},
+		"MX":    {{Priority: 10, Host: "mail.example.com"}},
+		"TXT":   {{Text: []string{"v=spf1 -all"}}},
+		"SRV":   {{Priority: 1, Weight: 5, Port: 5060, Host: "sip.example.com"}},
+		"caa":   {{Tag: "issue", Value: "letsencrypt.org"}},
+	}
+	for typ, records := range valid {
+		if err := validateRecords(typ, records); err != nil {
+			t.Errorf("Expected valid %s records, received %s", typ, err)
+		}
+	}
+
+	invalid := map[string][]Record{
+		"A":     {{IP: net.ParseIP("2606:2800:220:1::1")}},
+		"AAAA":  {{IP: net.ParseIP("93.184.216.34")}},
+		"CNAME": {{Host: "a.example.com"}, {Host: "b.example.com"}},
+		"MX":    {{Priority: 10}},
+		"TXT":   {},
+		"SOA":   {{Host: "ns1.example.com"}},
+	}
+	for typ, records := range invalid {
+		if err := validateRecords(typ, records); err == nil {
+			t.Errorf("Expected error for %s records %v", typ, records)
+		}
+	}
+}
+
+func TestVerifyRecordSet(t *testing.T) {
+	set := signed("Example.com.", "a", Record{IP: net.ParseIP("93.184.216.34"), TTL: DefaultTTL})
+	if err := set.Verify("example.com", "A"); err != nil {
+		t.Errorf("Expected signature to verify for the normalized name, received %s", err)
+	}
+	if err := set.Verify("example.org", "A"); err != ErrBadSignature {
+		t.Errorf("Expected signature to fail for another domain, received %v", err)
+	}
+
+	tampered := set
+	tampered.Records = []Record{{IP: net.ParseIP("10.0.0.1"), TTL: DefaultTTL}}
+	if err := tampered.Verify("example.com", "A"); err != ErrBadSignature {
+		t.Errorf("Expected signature to fail for changed records, received %v", err)
+	}
+
+	_, other, _ := ed25519.GenerateKey(nil)
+	forged := set
+	forged.Owner = other.Public().(ed25519.PublicKey)
+	if err := forged.Verify("example.com", "A"); err != ErrBadSignature {
+		t.Errorf("Expected signature to fail for another owner, received %v", err)
+	}
+}
+
+func TestVerifyTombstone(t *testing.T) {
+	tombstone := SignTombstone(testKey, "example.com", "A", nextSequence(0))
+	if err := tombstone.Verify("example.com", "A"); err != nil {
+		t.Errorf("Expected tombstone to verify, received %s", err)
+	}
+
+	revived := tombstone
+	revived.Deleted = false
+	if err := revived.Verify("example.com", "A"); err == nil {
+		t.Errorf("Expected error for an empty set that is not a tombstone")
+	}
+	filled := tombstone
+	filled.Records = []Record{{IP: net.ParseIP("10.0.0.1"), TTL: DefaultTTL}}
+	if err := filled.Verify("example.com", "A"); err == nil {
+		t.Errorf("Expected error for a tombstone holding records")
+	}
+	registration := SignTombstone(testKey, "example.com", RegistrationType, nextSequence(0))
+	if err := registration.Verify("example.com", RegistrationType); err == nil {
+		t.Errorf("Expected error for a tombstone deleting a registration")
+	}
+}
@@ -0,0 +1,87 @@
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"time"
+)
+
+// RegistrationType is the record type of the registration that binds a domain
+// to the key that owns it.  A registration holds a single record giving its
+// signing time, its expiry and the nonce of its proof-of-work.
+const RegistrationType = "REGISTRATION"
+
+// registrationSkew is how far the clocks of an owner and a replica may differ.
+// A replica only accepts a new claim on a domain signed within this long of
+// its own time.
+const registrationSkew = time.Minute
+
+// DefaultDifficulty is the number of leading zero bits the proof-of-work on a
+// registration needs unless the network is configured otherwise.
+const DefaultDifficulty = 20
+
+// MaxRegistrationLifetime is the longest a domain can be registered for
+// before its owner must register it again.
+const MaxRegistrationLifetime = 365 * 24 * time.Hour
+
+// ErrInsufficientWork is returned for registrations whose proof-of-work falls
+// short of the network's difficulty.
+var ErrInsufficientWork = errors.New("Registration has insufficient proof-of-work")
+
+// ErrNotRegistered is returned when a domain has no unexpired registration.
+var ErrNotRegistered = errors.New("Domain is not registered")
+
+// NewRegistration claims a domain for owner until expires, as the given
+// version of a claim signed at registered, searching for a nonce whose
+// proof-of-work has at least difficulty leading zero bits.
+func NewRegistration(owner ed25519.PrivateKey, domain string, sequence uint64, registered time.Time, expires time.Time, difficulty int) RecordSet {
+	public := owner.Public().(ed25519.PublicKey)
+	records := []Record{{Registered: registered.Truncate(time.Second), Expires: expires.Truncate(time.Second), Nonce: uint64(rand.Int63())}}
+	for registrationWork(domain, public, sequence, records) < difficulty {
+		records[0].Nonce++
+	}
+	return SignRecords(owner, domain, RegistrationType, sequence, records)
+}
+
+// registrationWork returns the number of leading zero bits in the hash of a
+// registration, which covers the owner's key so the work cannot be reused by
+// anyone else.
+func registrationWork(domain string, owner ed25519.PublicKey, sequence uint64, records []Record) (work int) {
+	hash := sha256.New()
+	hash.Write(owner)
+	hash.Write(signedData(domain, RegistrationType, sequence, records))
+	for _, b := range hash.Sum(nil) {
+		work += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return
+}
+
+// checkRegistration verifies that a signed registration has enough work, was
+// not claimed in the future and has neither expired nor been made to last too
+// long.
+func checkRegistration(domain string, set *RecordSet, difficulty int, now time.Time) error {
+	if err := set.Verify(domain, RegistrationType); err != nil {
+		return err
+	}
+	if registered := set.Records[0].Registered; registered.After(now.Add(registrationSkew)) {
+		return fmt.Errorf("Registration for %s claimed in the future at %s", domain, registered)
+	}
+	expires := set.Records[0].Expires
+	if !now.Before(expires) {
+		return fmt.Errorf("Registration for %s expired at %s", domain, expires)
+	}
+	if expires.Sub(now) > MaxRegistrationLifetime+registrationSkew {
+		return fmt.Errorf("Registration for %s lasts longer than %s", domain, MaxRegistrationLifetime)
+	}
+	if registrationWork(domain, set.Owner, set.Sequence, set.Records) < difficulty {
+		return ErrInsufficientWork
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package kademlia
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+// testDifficulty keeps the proof-of-work in tests quick
+const testDifficulty = 8
+
+// register claims a domain for testKey, failing the test if it cannot.
+func register(t *testing.T, k *Kademlia, domain string) {
+	t.Helper()
+	if err := k.Register(context.Background(), testKey, domain, time.Hour); err != nil {
+		t.Fatalf("Error registering %s: %s", domain, err)
+	}
+}
+
+func TestCheckRegistration(t *testing.T) {
+	now := time.Now()
+	set := NewRegistration(testKey, "example.com", 1, now, now.Add(time.Hour), testDifficulty)
+	if err := checkRegistration("example.com", &set, testDifficulty, now); err != nil {
+		t.Errorf("Expected valid registration, received %s", err)
+	}
+	if err := checkRegistration("example.com", &set, 64, now); err != ErrInsufficientWork {
+		t.Errorf("Expected ErrInsufficientWork against a higher difficulty, received %v", err)
+	}
+	if err := checkRegistration("example.com", &set, testDifficulty, now.Add(2*time.Hour)); err == nil {
+		t.Errorf("Expected error for an expired registration")
+	}
+
+	// The work is bound to the claimant, so it cannot be taken by another key
+	_, other, _ := ed25519.GenerateKey(nil)
+	stolen := SignRecords(other, "example.com", RegistrationType, set.Sequence, set.Records)
+	if registrationWork("example.com", stolen.Owner, stolen.Sequence, stolen.Records) < testDifficulty {
+		if err := checkRegistration("example.com", &stolen, testDifficulty, now); err != ErrInsufficientWork {
+			t.Errorf("Expected stolen work to fall short, received %v", err)
+		}
+	}
+
+	long := NewRegistration(testKey, "example.com", 1, now, now.Add(2*MaxRegistrationLifetime), testDifficulty)
+	if err := checkRegistration("example.com", &long, testDifficulty, now); err == nil {
+		t.Errorf("Expected error for a registration lasting too long")
+	}
+	future := NewRegistration(testKey, "example.com", 1, now.Add(time.Hour), now.Add(2*time.Hour), testDifficulty)
+	if err := checkRegistration("example.com", &future, testDifficulty, now); err == nil {
+		t.Errorf("Expected error for a registration claimed in the future")
+	}
+}
+
+func TestStoreRegistration(t *testing.T) {
+	k := newTestNode("127.0.0.1:8989")
+	k.Difficulty = testDifficulty
+	kc := kademliaCore{k}
+	header := newTestNode("127.0.0.1:8990").newHeader()
+
+	claim := NewRegistration(testKey, "example.com", 1, time.Now(), time.Now().Add(time.Hour), testDifficulty)
+	if err := kc.Store(&StoreRequest{header, "example.com", RegistrationType, claim, time.Hour, nil}, &StoreResponse{}); err != nil {
+		t.Fatalf("Error storing registration: %s", err)
+	}
+
+	_, other, _ := ed25519.GenerateKey(nil)
+	conflict := NewRegistration(other, "example.com", 1, time.Now(), time.Now().Add(time.Hour), testDifficulty)
+	if err := kc.Store(&StoreRequest{header, "example.com", RegistrationType, conflict, time.Hour, nil}, &StoreResponse{}); err != ErrNotOwner {
+		t.Errorf("Expected ErrNotOwner for a conflicting claim, received %v", err)
+	}
+
+	// A claim with too little work is refused even for an unclaimed name
+	k.Difficulty = 64
+	weak := NewRegistration(other, "example.org", 1, time.Now(), time.Now().Add(time.Hour), testDifficulty)
+	if err := kc.Store(&StoreRequest{header, "example.org", RegistrationType, weak, time.Hour, nil}, &StoreResponse{}); err != ErrInsufficientWork {
+		t.Errorf("Expected ErrInsufficientWork for a weak claim, received %v", err)
+	}
+
+	// Stored registrations go no further than their own expiry
+	k.domains.expire(time.Now().Add(2 * time.Hour))
+	if stored := k.domains.retrieve("example.com", RegistrationType).Records; stored != nil {
+		t.Errorf("Expected registration to expire with its claim, found %v", stored)
+	}
+}
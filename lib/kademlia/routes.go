@@ -0,0 +1,138 @@
+package kademlia
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SavedRoutes is the contacts in a node's routing table, as saved so that a
+// restarted node can rejoin the network without going back to its seeds.  The
+// node keeps its place in the keyspace by keeping its key.
+type SavedRoutes struct {
+	Contacts []SavedContact
+}
+
+// SavedContact is a contact from a saved routing table.
+type SavedContact struct {
+	Contact  Contact
+	LastSeen time.Time
+}
+
+// SaveRoutes writes the node's routing table to a file, replacing it only once
+// the new copy is complete.
+func (k *Kademlia) SaveRoutes(path string) (err error) {
+	temp := path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	writer := bufio.NewWriter(file)
+	fmt.Fprintf(writer, "# routing table of %s, saved %s\n", k.routes.node.id, time.Now().UTC().Format(time.RFC3339))
+	for _, saved := range k.routes.saved() {
+		fmt.Fprintf(writer, "%s@%s %d\n", saved.Contact.id, saved.Contact.address, saved.LastSeen.Unix())
+	}
+	if err = writer.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		os.Remove(temp)
+	}
+	return
+}
+
+// LoadRoutes reads a routing table saved by SaveRoutes.  A missing file gives
+// empty routes rather than an error.
+func LoadRoutes(path string) (ret SavedRoutes, err error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ret, nil
+	} else if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return SavedRoutes{}, fmt.Errorf("%s:%d: Expected 2 fields, found %d", path, line, len(fields))
+		}
+		contact, err := ParseSeed(fields[0])
+		if err == nil && contact.id.Equals(NodeID{}) {
+			err = fmt.Errorf("Missing node id in %q", fields[0])
+		}
+		seen, serr := strconv.ParseInt(fields[1], 10, 64)
+		if err == nil && serr != nil {
+			err = fmt.Errorf("Invalid last seen time %q", fields[1])
+		}
+		if err != nil {
+			return SavedRoutes{}, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		ret.Contacts = append(ret.Contacts, SavedContact{contact, time.Unix(seen, 0)})
+	}
+	err = scanner.Err()
+	return
+}
+
+// Rejoin starts serving RPCs for the node and re-enters the network through
+// the contacts of a saved routing table, keeping those that still answer a
+// ping under the same id, in the order they were last seen.  It returns how
+// many answered; with none, the node is left to Join through its seeds.
+// Saved contacts hold no keys, so each is kept with the key it proves it
+// holds in its reply.
+func (k *Kademlia) Rejoin(ctx context.Context, saved []SavedContact) (alive int, err error) {
+	if err = k.serve(); err != nil {
+		return
+	}
+
+	var mutex sync.Mutex
+	var live []SavedContact
+	var wg sync.WaitGroup
+	for _, contact := range saved {
+		wg.Add(1)
+		go func(contact SavedContact) {
+			defer wg.Done()
+			// A different node may have taken over the address since,
+			// in which case call refuses its reply
+			args := PingRequest{k.newHeader()}
+			reply := PingResponse{}
+			if k.call(ctx, &contact.Contact, "kademliaCore.Ping", &args, &reply) == nil {
+				contact.Contact.key = reply.Sender.key
+				mutex.Lock()
+				live = append(live, contact)
+				mutex.Unlock()
+			}
+		}(contact)
+	}
+	wg.Wait()
+	if alive = len(live); alive == 0 {
+		return
+	}
+
+	// Answering moved every contact to the front of its bucket in whatever
+	// order the pings came back; put the most recently seen back in front
+	sort.Slice(live, func(i, j int) bool { return live[i].LastSeen.Before(live[j].LastSeen) })
+	for i := range live {
+		k.routes.insert(&live[i].Contact)
+	}
+	k.populate(ctx)
+	return
+}
@@ -0,0 +1,143 @@
+package kademlia
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveLoadRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes")
+	if routes, err := LoadRoutes(path); err != nil || routes.Contacts != nil {
+		t.Errorf("Expected empty routes for a missing file, obtained %v (%v)", routes, err)
+	}
+
+	k := newTestNode("127.0.0.1:8989")
+	first := newTestNode("127.0.0.1:9000").routes.node
+	second := newTestNode("127.0.0.1:9001").routes.node
+	k.routes.insert(&first)
+	k.routes.insert(&second)
+	if err := k.SaveRoutes(path); err != nil {
+		t.Fatalf("Error saving routes: %s", err)
+	}
+
+	routes, err := LoadRoutes(path)
+	if err != nil {
+		t.Fatalf("Error loading routes: %s", err)
+	}
+	if len(routes.Contacts) != 2 {
+		t.Fatalf("Expected 2 contacts, obtained %v", routes.Contacts)
+	}
+	for _, saved := range routes.Contacts {
+		if !saved.Contact.id.Equals(first.id) && !saved.Contact.id.Equals(second.id) || saved.LastSeen.IsZero() {
+			t.Errorf("Expected a saved contact with a last seen time, obtained %v", saved)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("127.0.0.1:9000\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRoutes(path); err == nil {
+		t.Errorf("Expected error loading a malformed routes file")
+	}
+	if err := os.WriteFile(path, []byte("127.0.0.1:9000 0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRoutes(path); err == nil {
+		t.Errorf("Expected error loading a contact without a node id")
+	}
+}
+
+func TestCloseSavesRoutes(t *testing.T) {
+	network := NewSimNetwork(1)
+	seed := newTestNode("127.0.0.1:9002")
+	seed.Transport = network.NewTransport()
+	if err := seed.Join(context.Background()); err != nil {
+		t.Fatalf("Error starting network: %s", err)
+	}
+	defer seed.Close()
+
+	path := filepath.Join(t.TempDir(), "routes")
+	k := newTestNode("127.0.0.1:9003")
+	k.Transport = network.NewTransport()
+	k.RoutesFile = path
+	k.RefreshInterval = time.Millisecond
+	if err := k.Join(context.Background(), seed.routes.node); err != nil {
+		t.Fatalf("Error joining network: %s", err)
+	}
+
+	// Maintenance saves the routes every tick; closing waits for it to stop
+	// before saving them the last time
+	time.Sleep(20 * time.Millisecond)
+	if err := k.Close(); err != nil {
+		t.Fatalf("Error closing node: %s", err)
+	}
+	if _, err := os.Stat(path + ".tmp"); err == nil {
+		t.Errorf("Expected no partial routes file to be left behind")
+	}
+	if routes, err := LoadRoutes(path); err != nil || len(routes.Contacts) != 1 {
+		t.Errorf("Expected the saved contact, obtained %v (%v)", routes, err)
+	}
+}
+
+func TestSimRejoin(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newSimNodes(t, network, 10)
+	defer closeSimNodes(nodes)
+
+	path := filepath.Join(t.TempDir(), "routes")
+	nodes[0].RoutesFile = path
+	nodes[0].Close()
+	routes, err := LoadRoutes(path)
+	if err != nil {
+		t.Fatalf("Error loading routes: %s", err)
+	}
+
+	// One contact has gone away and another address now belongs to a
+	// different node
+	gone, replaced := routes.Contacts[0].Contact, routes.Contacts[1].Contact
+	for _, k := range nodes {
+		if k.routes.node.id.Equals(gone.id) || k.routes.node.id.Equals(replaced.id) {
+			k.Close()
+		}
+	}
+	newcomer := newTestNode(replaced.address)
+	newcomer.Transport = network.NewTransport()
+	if err := newcomer.Join(context.Background()); err != nil {
+		t.Fatalf("Error starting node at %s: %s", replaced.address, err)
+	}
+	defer newcomer.Close()
+
+	// The node restarts with the key it had before
+	self := nodes[0].routes.node.id
+	k := NewKademlia(nodes[0].key, "node0", "test")
+	k.NodeDifficulty = testNodeDifficulty
+	k.Transport = network.NewTransport()
+	defer k.Close()
+	alive, err := k.Rejoin(context.Background(), routes.Contacts)
+	if err != nil {
+		t.Fatalf("Error rejoining: %s", err)
+	}
+	if alive != len(routes.Contacts)-2 {
+		t.Errorf("Expected %d of %d saved contacts to answer, found %d", len(routes.Contacts)-2, len(routes.Contacts), alive)
+	}
+	if closest := k.routes.findClosest(gone.id, 1); len(closest) > 0 && closest[0].node.id.Equals(gone.id) {
+		t.Errorf("Expected contact that went away to be left out of the routing table")
+	}
+	if closest := k.routes.findClosest(replaced.id, 1); len(closest) > 0 && closest[0].node.id.Equals(replaced.id) {
+		t.Errorf("Expected contact whose address was taken over to be left out of the routing table")
+	}
+
+	// The restarted node is reachable again under its old id
+	for i := 1; i < len(nodes); i++ {
+		if nodes[i].routes.node.id.Equals(gone.id) || nodes[i].routes.node.id.Equals(replaced.id) {
+			continue
+		}
+		closest := nodes[i].iterativeFindNode(context.Background(), self, alpha)
+		if len(closest) == 0 || !closest[0].node.id.Equals(self) {
+			t.Errorf("Node %d expected to find the restarted node %s", i, self)
+		}
+	}
+}
@@ -3,14 +3,34 @@ package kademlia
 import (
 	"container/list"
 	"sort"
+	"sync"
+	"time"
 )
 
 const bucketSize = 20
 
-// RoutingTable - store routing table in bucket lists
+// RoutingTable - store routing table in bucket lists, safe for concurrent use
 type RoutingTable struct {
-	node    Contact
-	buckets [idLength * 8]*list.List
+	node         Contact
+	mutex        sync.Mutex
+	buckets      [idLength * 8]*list.List
+	replacements [idLength * 8]*list.List
+	lastLookup   [idLength * 8]time.Time
+	lastSeen     map[NodeID]time.Time // for contacts in buckets and replacement caches
+}
+
+// RoutingStats - contact and replacement cache sizes across the routing table
+type RoutingStats struct {
+	Contacts     int
+	Replacements int
+	Buckets      [idLength * 8]BucketStats
+}
+
+// BucketStats - contact and replacement cache sizes and last lookup time for a single bucket
+type BucketStats struct {
+	Contacts     int
+	Replacements int
+	LastLookup   time.Time
 }
 
 // ContactRecord type is an individual contact record with node id for sortKey
@@ -29,34 +49,114 @@ func NewRoutingTable(node *Contact) (ret *RoutingTable) {
 	ret = new(RoutingTable)
 	for i := 0; i < idLength*8; i++ {
 		ret.buckets[i] = list.New()
+		ret.replacements[i] = list.New()
+		ret.lastLookup[i] = time.Now()
 	}
 	ret.node = *node
+	ret.lastSeen = make(map[NodeID]time.Time)
 	return
 }
 
-func (table *RoutingTable) findClosest(target NodeID, count int) (ret contactRecList) {
+// bucketIndex returns the index of the bucket that holds the given id.
+func (table *RoutingTable) bucketIndex(id NodeID) int {
+	return id.Xor(table.node.id).PrefixLen()
+}
+
+// insert moves a known contact to the front of its bucket, or adds a new one if
+// the bucket has room.  If the bucket is full it returns the least recently
+// seen contact, which the caller should check on before trying again.
+func (table *RoutingTable) insert(contact *Contact) (last *Contact) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	bucket := table.buckets[table.bucketIndex(contact.id)]
+	if elt := findContact(bucket, contact.id); elt != nil {
+		bucket.MoveToFront(elt)
+	} else if bucket.Len() < bucketSize {
+		table.removeReplacement(contact.id)
+		bucket.PushFront(contact)
+	} else {
+		return bucket.Back().Value.(*Contact)
+	}
+	table.lastSeen[contact.id] = time.Now()
+	return
+}
+
+func findContact(l *list.List, id NodeID) *list.Element {
+	for elt := l.Front(); elt != nil; elt = elt.Next() {
+		if elt.Value.(*Contact).id.Equals(id) {
+			return elt
+		}
+	}
+	return nil
+}
+
+// addReplacement caches a contact seen while its bucket was full, most recently
+// seen first, discarding the stalest entry once the cache is full.
+func (table *RoutingTable) addReplacement(contact *Contact) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
 
-	bucketNum := target.Xor(table.node.id).PrefixLen()
-	bucket := table.buckets[bucketNum]
-	for elt := bucket.Front(); elt != nil; elt = elt.Next() {
-		contact := elt.Value.(*Contact)
-		ret = append(ret, &ContactRecord{contact, contact.id.Xor(target)})
+	cache := table.replacements[table.bucketIndex(contact.id)]
+	if elt := findContact(cache, contact.id); elt != nil {
+		cache.Remove(elt)
 	}
+	cache.PushFront(contact)
+	table.lastSeen[contact.id] = time.Now()
+	if cache.Len() > bucketSize {
+		delete(table.lastSeen, cache.Remove(cache.Back()).(*Contact).id)
+	}
+}
+
+// removeReplacement drops a contact from its bucket's replacement cache; the
+// table must already be locked.
+func (table *RoutingTable) removeReplacement(id NodeID) {
+	cache := table.replacements[table.bucketIndex(id)]
+	if elt := findContact(cache, id); elt != nil {
+		cache.Remove(elt)
+	}
+}
 
-	for i := 1; (bucketNum-i >= 0 || bucketNum+i < idLength*8) && ret.Len() < count; i++ {
-		if bucketNum-i >= 0 {
-			bucket = table.buckets[bucketNum-i]
-			for elt := bucket.Front(); elt != nil; elt = elt.Next() {
-				contact := elt.Value.(*Contact)
-				ret = append(ret, &ContactRecord{contact, contact.id.Xor(target)})
-			}
+// remove drops a contact that failed to respond, promoting the most recently
+// seen replacement for its bucket in its place.
+func (table *RoutingTable) remove(id NodeID) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	index := table.bucketIndex(id)
+	bucket := table.buckets[index]
+	if elt := findContact(bucket, id); elt != nil {
+		bucket.Remove(elt)
+		delete(table.lastSeen, id)
+		if cache := table.replacements[index]; cache.Len() > 0 {
+			bucket.PushBack(cache.Remove(cache.Front()))
 		}
-		if bucketNum+i < idLength*8 {
-			bucket = table.buckets[bucketNum+i]
-			for elt := bucket.Front(); elt != nil; elt = elt.Next() {
-				contact := elt.Value.(*Contact)
-				ret = append(ret, &ContactRecord{contact, contact.id.Xor(target)})
-			}
+	}
+}
+
+func (table *RoutingTable) stats() (ret RoutingStats) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	for i := 0; i < idLength*8; i++ {
+		ret.Buckets[i] = BucketStats{table.buckets[i].Len(), table.replacements[i].Len(), table.lastLookup[i]}
+		ret.Contacts += ret.Buckets[i].Contacts
+		ret.Replacements += ret.Buckets[i].Replacements
+	}
+	return
+}
+
+// findClosest returns the count contacts closest to target.  Every bucket is
+// searched, since a bucket nearer the target's own can hold contacts further
+// from it than a bucket on the other side.
+func (table *RoutingTable) findClosest(target NodeID, count int) (ret contactRecList) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	for _, bucket := range table.buckets {
+		for elt := bucket.Front(); elt != nil; elt = elt.Next() {
+			contact := elt.Value.(*Contact)
+			ret = append(ret, &ContactRecord{contact, contact.id.Xor(target)})
 		}
 	}
 
@@ -66,3 +166,69 @@ func (table *RoutingTable) findClosest(target NodeID, count int) (ret contactRec
 	}
 	return
 }
+
+// closestBucket returns the index of the bucket holding our closest neighbor,
+// or -1 if the table is empty.
+func (table *RoutingTable) closestBucket() int {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	return table.closestBucketLocked()
+}
+
+func (table *RoutingTable) closestBucketLocked() int {
+	for i := idLength*8 - 1; i >= 0; i-- {
+		if table.buckets[i].Len() > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// touch records a lookup in the bucket covering target.
+func (table *RoutingTable) touch(target NodeID) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.lastLookup[table.bucketIndex(target)] = time.Now()
+}
+
+// stale returns the buckets, out to our closest neighbor's, that have not
+// seen a lookup since cutoff.  Closer buckets cannot hold any contacts yet.
+func (table *RoutingTable) stale(cutoff time.Time) (ret []int) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	for i := 0; i <= table.closestBucketLocked(); i++ {
+		if table.lastLookup[i].Before(cutoff) {
+			ret = append(ret, i)
+		}
+	}
+	return
+}
+
+// randomIDInBucket returns a random node id that falls in the given bucket.
+func (table *RoutingTable) randomIDInBucket(bucket int) NodeID {
+	distance := NewRandomNodeID()
+	for i := 0; i < bucket/8; i++ {
+		distance[i] = 0
+	}
+	// Clear the shared prefix bits and set the first differing bit
+	shift := uint8(bucket % 8)
+	distance[bucket/8] &= 0xFF >> shift
+	distance[bucket/8] |= 0x80 >> shift
+	return distance.Xor(table.node.id)
+}
+
+// saved returns the contacts in the buckets along with when each was last
+// seen, the least recently seen of each bucket first.
+func (table *RoutingTable) saved() (ret []SavedContact) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	for _, bucket := range table.buckets {
+		for elt := bucket.Back(); elt != nil; elt = elt.Prev() {
+			contact := elt.Value.(*Contact)
+			ret = append(ret, SavedContact{*contact, table.lastSeen[contact.id]})
+		}
+	}
+	return
+}
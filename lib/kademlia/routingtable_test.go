@@ -1,16 +1,18 @@
 package kademlia
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRoutingTable(t *testing.T) {
-	n1 := NewNodeID("FFFFFFFF00000000000000000000000000000000")
 	n2 := NewNodeID("FFFFFFF000000000000000000000000000000000")
 	n3 := NewNodeID("1111111100000000000000000000000000000000")
-	k := NewKademlia(&Contact{n1, "localhost:8000"}, "test")
-	k.update(&Contact{n2, "localhost:8001"}, k.routes)
-	k.update(&Contact{n3, "localhost:8002"}, k.routes)
+	k := newTestNode("localhost:8000")
+	k.update(&Contact{id: n2, address: "localhost:8001"}, k.routes)
+	k.update(&Contact{id: n3, address: "localhost:8002"}, k.routes)
 
 	vec := k.routes.findClosest(NewNodeID("2222222200000000000000000000000000000000"), 1)
 	if len(vec) != 1 {
@@ -33,3 +35,103 @@ func TestRoutingTable(t *testing.T) {
 		t.Errorf("Expected %s, returned %s.", n3.String(), vec[1].node.id.String())
 	}
 }
+
+func TestFindClosestAcrossBuckets(t *testing.T) {
+	table := NewRoutingTable(&Contact{id: NewNodeID("0000000000000000000000000000000000000000"), address: "localhost:8000"})
+	for i, id := range []string{
+		"4100000000000000000000000000000000000000", // in the target's bucket
+		"8000000000000000000000000000000000000000", // one bucket further from us
+		"2000000000000000000000000000000000000000", // one bucket nearer us
+		"1000000000000000000000000000000000000000", // two buckets nearer, and nearer the target too
+	} {
+		table.insert(&Contact{id: NewNodeID(id), address: fmt.Sprintf("localhost:%d", 8001+i)})
+	}
+
+	vec := table.findClosest(NewNodeID("4000000000000000000000000000000000000000"), 3)
+	if len(vec) != 3 {
+		t.Fatalf("Returned incorrect number - %d closest nodes.  Expected 3.", len(vec))
+	}
+	for i, expected := range []string{"41", "10", "20"} {
+		if !strings.HasPrefix(vec[i].node.id.String(), expected) {
+			t.Errorf("Expected contact %s... at position %d, found %s", expected, i, vec[i].node)
+		}
+	}
+}
+
+func TestRandomIDInBucket(t *testing.T) {
+	table := NewRoutingTable(&Contact{id: NewRandomNodeID(), address: "localhost:8000"})
+	for _, bucket := range []int{0, 1, 7, 8, 63, 158} {
+		id := table.randomIDInBucket(bucket)
+		if prefix := id.Xor(table.node.id).PrefixLen(); prefix != bucket {
+			t.Errorf("Expected id in bucket %d, obtained bucket %d", bucket, prefix)
+		}
+	}
+
+	if table.closestBucket() != -1 {
+		t.Errorf("Expected no closest bucket in empty table, obtained %d", table.closestBucket())
+	}
+	table.buckets[42].PushFront(&Contact{id: table.randomIDInBucket(42), address: "localhost:8001"})
+	if table.closestBucket() != 42 {
+		t.Errorf("Expected closest bucket 42, obtained %d", table.closestBucket())
+	}
+}
+
+func TestReplacementCache(t *testing.T) {
+	table := NewRoutingTable(&Contact{id: NewRandomNodeID(), address: "localhost:8000"})
+	var contacts [bucketSize]*Contact
+	for i := range contacts {
+		contacts[i] = &Contact{id: table.randomIDInBucket(3), address: "localhost:8001"}
+		table.buckets[3].PushFront(contacts[i])
+	}
+
+	a := &Contact{id: table.randomIDInBucket(3), address: "localhost:8002"}
+	b := &Contact{id: table.randomIDInBucket(3), address: "localhost:8003"}
+	table.addReplacement(a)
+	table.addReplacement(b)
+	table.addReplacement(a)
+
+	stats := table.stats()
+	if stats.Contacts != bucketSize || stats.Replacements != 2 || stats.Buckets[3].Replacements != 2 {
+		t.Errorf("Expected %d contacts and 2 replacements, found %d and %d", bucketSize, stats.Contacts, stats.Replacements)
+	}
+
+	// The most recently seen replacement is promoted first
+	table.remove(contacts[0].id)
+	if findContact(table.buckets[3], contacts[0].id) != nil {
+		t.Errorf("Expected %s to be removed", contacts[0])
+	}
+	if findContact(table.buckets[3], a.id) == nil {
+		t.Errorf("Expected %s to be promoted", a)
+	}
+	if stats = table.stats(); stats.Contacts != bucketSize || stats.Replacements != 1 {
+		t.Errorf("Expected %d contacts and 1 replacement, found %d and %d", bucketSize, stats.Contacts, stats.Replacements)
+	}
+
+	for i := 0; i < bucketSize+5; i++ {
+		table.addReplacement(&Contact{id: table.randomIDInBucket(3), address: "localhost:8004"})
+	}
+	if stats = table.stats(); stats.Replacements != bucketSize {
+		t.Errorf("Expected replacement cache capped at %d, found %d", bucketSize, stats.Replacements)
+	}
+}
+
+func TestStaleBuckets(t *testing.T) {
+	table := NewRoutingTable(&Contact{id: NewRandomNodeID(), address: "localhost:8000"})
+	table.buckets[10].PushFront(&Contact{id: table.randomIDInBucket(10), address: "localhost:8001"})
+
+	hourAgo := time.Now().Add(-time.Hour)
+	if stale := table.stale(hourAgo); len(stale) != 0 {
+		t.Errorf("Expected no stale buckets in new table, found %v", stale)
+	}
+
+	table.lastLookup[3] = hourAgo.Add(-time.Minute)
+	table.lastLookup[42] = hourAgo.Add(-time.Minute)
+	if stale := table.stale(hourAgo); len(stale) != 1 || stale[0] != 3 {
+		t.Errorf("Expected only bucket 3 to be stale, found %v", stale)
+	}
+
+	table.touch(table.randomIDInBucket(3))
+	if stale := table.stale(hourAgo); len(stale) != 0 {
+		t.Errorf("Expected touched bucket to be fresh, found %v", stale)
+	}
+}
@@ -0,0 +1,68 @@
+package kademlia
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ParseSeed parses a bootstrap contact written as "address" or "nodeid@address".
+func ParseSeed(seed string) (ret Contact, err error) {
+	seed = strings.TrimSpace(seed)
+	if i := strings.Index(seed, "@"); i >= 0 {
+		// A zero id would let any node answer for the seed
+		id, err := hex.DecodeString(seed[:i])
+		if err != nil || len(id) != idLength {
+			return ret, fmt.Errorf("Invalid node id in seed %q", seed)
+		}
+		copy(ret.id[:], id)
+		seed = seed[i+1:]
+	}
+	if seed == "" {
+		return ret, fmt.Errorf("Missing address in seed")
+	}
+	ret.address = seed
+	return
+}
+
+// ParseSeedList parses a comma separated list of bootstrap contacts.
+func ParseSeedList(list string) (ret []Contact, err error) {
+	for _, seed := range strings.Split(list, ",") {
+		if strings.TrimSpace(seed) == "" {
+			continue
+		}
+		contact, err := ParseSeed(seed)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, contact)
+	}
+	return
+}
+
+// LoadSeeds reads bootstrap contacts from a file with one seed per line.
+// Blank lines and lines starting with # are ignored.
+func LoadSeeds(path string) (ret []Contact, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		contact, err := ParseSeed(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		ret = append(ret, contact)
+	}
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,68 @@
+package kademlia
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSeed(t *testing.T) {
+	id := "0123456789abcdef0123456789abcdef01234567"
+	seed, err := ParseSeed(id + "@127.0.0.1:8000")
+	if err != nil {
+		t.Fatalf("Error parsing seed: %s", err)
+	}
+	if seed.id.String() != id || seed.address != "127.0.0.1:8000" {
+		t.Errorf("Expected %s at 127.0.0.1:8000, obtained %s", id, &seed)
+	}
+
+	if seed, err = ParseSeed(" seed.example.com:8000 "); err != nil || seed.address != "seed.example.com:8000" {
+		t.Errorf("Expected seed.example.com:8000, obtained %s (%v)", &seed, err)
+	}
+	if !seed.id.Equals(NodeID{}) {
+		t.Errorf("Expected zero id for address-only seed, obtained %s", seed.id)
+	}
+
+	if _, err = ParseSeed("abcd@127.0.0.1:8000"); err == nil {
+		t.Errorf("Expected error for short node id")
+	}
+	if _, err = ParseSeed("0123456789abcdef0123456789abcdef0123456z@127.0.0.1:8000"); err == nil {
+		t.Errorf("Expected error for a node id that is not hex")
+	}
+	if _, err = ParseSeed(id + "@"); err == nil {
+		t.Errorf("Expected error for missing address")
+	}
+}
+
+func TestParseSeedList(t *testing.T) {
+	seeds, err := ParseSeedList("127.0.0.1:8000, 127.0.0.1:8001,")
+	if err != nil {
+		t.Fatalf("Error parsing seed list: %s", err)
+	}
+	if len(seeds) != 2 || seeds[1].address != "127.0.0.1:8001" {
+		t.Errorf("Expected 2 seeds, obtained %v", seeds)
+	}
+}
+
+func TestLoadSeeds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seeds")
+	data := "# bootstrap nodes\n127.0.0.1:8000\n\n0123456789abcdef0123456789abcdef01234567@127.0.0.1:8001\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	seeds, err := LoadSeeds(path)
+	if err != nil {
+		t.Fatalf("Error loading seeds: %s", err)
+	}
+	if len(seeds) != 2 || seeds[0].address != "127.0.0.1:8000" || seeds[1].address != "127.0.0.1:8001" {
+		t.Errorf("Expected 2 seeds from file, obtained %v", seeds)
+	}
+
+	if err := os.WriteFile(path, []byte("bad@127.0.0.1:8000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSeeds(path); err == nil {
+		t.Errorf("Expected error loading malformed seed file")
+	}
+}
@@ -0,0 +1,179 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SimNetwork is an in-process network for running many Kademlia nodes in one
+// program.  Nodes attach to it through transports from NewTransport, and the
+// messages between them can be delayed, dropped or partitioned.
+type SimNetwork struct {
+	mutex    sync.Mutex
+	handlers map[string]Handler
+	groups   map[string]int
+	latency  time.Duration
+	loss     float64
+	random   *rand.Rand
+}
+
+// SimTransport attaches a single node to a SimNetwork.
+type SimTransport struct {
+	network *SimNetwork
+	mutex   sync.Mutex
+	address string
+}
+
+// NewSimNetwork creates an empty simulated network, seeding its packet loss
+// so runs can be repeated.
+func NewSimNetwork(seed int64) *SimNetwork {
+	return &SimNetwork{
+		handlers: make(map[string]Handler),
+		groups:   make(map[string]int),
+		random:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// NewTransport creates a transport for a node on the network.
+func (n *SimNetwork) NewTransport() *SimTransport {
+	return &SimTransport{network: n}
+}
+
+// SetLatency delays every message, request or reply, by latency.
+func (n *SimNetwork) SetLatency(latency time.Duration) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.latency = latency
+}
+
+// SetLoss drops each message with the given probability.  A lost message
+// fails its call at once, as though the caller's timeout had expired.
+func (n *SimNetwork) SetLoss(probability float64) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.loss = probability
+}
+
+// Partition splits the network so that nodes can only reach others in the
+// same group.  Addresses not listed in any group form one more group.
+func (n *SimNetwork) Partition(groups ...[]string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, address := range group {
+			n.groups[address] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (n *SimNetwork) Heal() {
+	n.Partition()
+}
+
+// send carries a message from one address to another, failing if the two
+// are partitioned or the message is lost, and waiting out the latency unless
+// ctx is done first.
+func (n *SimNetwork) send(ctx context.Context, from string, to string) error {
+	n.mutex.Lock()
+	if n.groups[from] != n.groups[to] {
+		n.mutex.Unlock()
+		return fmt.Errorf("Network partitioned between %s and %s", from, to)
+	}
+	lost := n.loss > 0 && n.random.Float64() < n.loss
+	latency := n.latency
+	n.mutex.Unlock()
+
+	if lost {
+		return fmt.Errorf("Message from %s to %s lost", from, to)
+	}
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return ctx.Err()
+}
+
+func (n *SimNetwork) handler(address string) Handler {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.handlers[address]
+}
+
+// Listen attaches handler to the network at address.
+func (t *SimTransport) Listen(address string, handler Handler) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.address != "" {
+		return fmt.Errorf("Already listening on %s", t.address)
+	}
+
+	t.network.mutex.Lock()
+	defer t.network.mutex.Unlock()
+	if t.network.handlers[address] != nil {
+		return fmt.Errorf("Address %s already in use", address)
+	}
+	t.network.handlers[address] = handler
+	t.address = address
+	return nil
+}
+
+// Call delivers an RPC to the node at address.  Arguments and replies are
+// copied through gob, just as they would be over a real connection.
+func (t *SimTransport) Call(ctx context.Context, address string, method string, args, reply interface{}) (err error) {
+	t.mutex.Lock()
+	from := t.address
+	t.mutex.Unlock()
+
+	if err = t.network.send(ctx, from, address); err != nil {
+		return
+	}
+	handler := t.network.handler(address)
+	if handler == nil {
+		return fmt.Errorf("No node listening on %s", address)
+	}
+
+	var request bytes.Buffer
+	if err = gob.NewEncoder(&request).Encode(args); err != nil {
+		return
+	}
+	response, err := dispatch(handler, method, func(args interface{}) error {
+		return gob.NewDecoder(&request).Decode(args)
+	})
+	if err != nil {
+		return RemoteError(err.Error())
+	}
+
+	if err = t.network.send(ctx, address, from); err != nil {
+		return
+	}
+	var body bytes.Buffer
+	if err = gob.NewEncoder(&body).Encode(response); err != nil {
+		return
+	}
+	return gob.NewDecoder(&body).Decode(reply)
+}
+
+// Close detaches the node from the network.
+func (t *SimTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.address != "" {
+		t.network.mutex.Lock()
+		delete(t.network.handlers, t.address)
+		t.network.mutex.Unlock()
+		t.address = ""
+	}
+	return nil
+}
@@ -0,0 +1,435 @@
+package kademlia
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newSimNodes starts count nodes on the network, each joining through a
+// random node that joined before it.
+func newSimNodes(t *testing.T, network *SimNetwork, count int) (nodes []*Kademlia) {
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < count; i++ {
+		k := newTestNode(fmt.Sprintf("node%d", i))
+		k.Difficulty = testDifficulty
+		k.Transport = network.NewTransport()
+
+		var err error
+		if i == 0 {
+			err = k.Join(context.Background())
+		} else {
+			err = k.Join(context.Background(), NewContact(NodeID{}, nodes[random.Intn(i)].routes.node.address))
+		}
+		if err != nil {
+			t.Fatalf("Error joining node %d: %s", i, err)
+		}
+		nodes = append(nodes, k)
+	}
+	return
+}
+
+func closeSimNodes(nodes []*Kademlia) {
+	for _, k := range nodes {
+		k.Close()
+	}
+}
+
+func TestSimFindNodeConverges(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newSimNodes(t, network, 100)
+	defer closeSimNodes(nodes)
+
+	random := rand.New(rand.NewSource(2))
+	for i := 0; i < 20; i++ {
+		target := NewRandomNodeID()
+		from := nodes[random.Intn(len(nodes))]
+
+		// The true k closest nodes other than the one searching
+		var expected contactRecList
+		for _, k := range nodes {
+			if k != from {
+				expected = append(expected, &ContactRecord{&k.routes.node, k.routes.node.id.Xor(target)})
+			}
+		}
+		sort.Sort(expected)
+		expected = expected[:bucketSize]
+
+		found := from.iterativeFindNode(context.Background(), target, alpha)
+		if len(found) != bucketSize {
+			t.Errorf("Lookup %d expected %d contacts, found %d", i, bucketSize, len(found))
+			continue
+		}
+		for j := range expected {
+			if !found[j].node.id.Equals(expected[j].node.id) {
+				t.Errorf("Lookup %d expected %s at position %d, found %s", i, expected[j].node.id, j, found[j].node.id)
+				break
+			}
+		}
+	}
+}
+
+func TestSimPutGet(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newSimNodes(t, network, 100)
+	defer closeSimNodes(nodes)
+
+	random := rand.New(rand.NewSource(3))
+	for i := 0; i < 20; i++ {
+		domain := fmt.Sprintf("host%d.example.com", i)
+		ip := net.IPv4(10, 0, 0, byte(i))
+		publisher := nodes[random.Intn(len(nodes))]
+		register(t, publisher, domain)
+		if err := publisher.Put(context.Background(), testKey, domain, "A", Record{IP: ip}); err != nil {
+			t.Errorf("Error putting %s: %s", domain, err)
+		}
+
+		from := nodes[random.Intn(len(nodes))]
+		if found, err := from.Get(context.Background(), domain, "A"); err != nil || !onlyIP(found).Equal(ip) {
+			t.Errorf("Node %s expected %s for %s, received %v (%v)", from.routes.node.address, ip, domain, found, err)
+		}
+	}
+}
+
+func TestSimRejectedPut(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newSimNodes(t, network, 20)
+	defer closeSimNodes(nodes)
+	register(t, nodes[0], "www.google.com")
+
+	// Every other node holds a version newer than the one about to be put,
+	// so each of them refuses it as stale
+	newer := SignRecords(testKey, "www.google.com", "A", nextSequence(0)+uint64(time.Hour), []Record{{IP: net.ParseIP("10.0.0.1"), TTL: DefaultTTL}})
+	for _, k := range nodes[1:] {
+		k.domains.mutex.Lock()
+		k.domains.put("www.google.com", "A", &domainRecord{newer, time.Now().Add(time.Hour), time.Now(), false})
+		k.domains.mutex.Unlock()
+	}
+	if err := nodes[0].Put(context.Background(), testKey, "www.google.com", "A", Record{IP: net.ParseIP("74.125.224.72")}); err != ErrNotStored {
+		t.Errorf("Expected ErrNotStored when every replica refuses the set, received %v", err)
+	}
+}
+
+func TestSimLossAndLatency(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newSimNodes(t, network, 50)
+	defer closeSimNodes(nodes)
+
+	ip := net.ParseIP("74.125.224.72")
+	register(t, nodes[0], "www.google.com")
+	if err := nodes[0].Put(context.Background(), testKey, "www.google.com", "A", Record{IP: ip}); err != nil {
+		t.Fatalf("Error putting www.google.com: %s", err)
+	}
+
+	// Records are held by many nodes, so lookups survive a lossy, slow network
+	network.SetLoss(0.1)
+	network.SetLatency(time.Millisecond)
+	for i := 1; i < len(nodes); i += 10 {
+		if found, err := nodes[i].Get(context.Background(), "www.google.com", "A"); err != nil || !onlyIP(found).Equal(ip) {
+			t.Errorf("Node %d expected %s for www.google.com, received %v (%v)", i, ip, found, err)
+		}
+	}
+}
+
+func TestSimLookupDeadline(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newSimNodes(t, network, 20)
+	defer closeSimNodes(nodes)
+
+	// Peers that never answer in time must not hold a lookup up past its
+	// deadline, nor be dropped for our impatience
+	k := nodes[0]
+	k.RPCTimeout = time.Hour
+	k.LookupTimeout = 100 * time.Millisecond
+	before := k.Stats().Contacts
+	network.SetLatency(time.Hour)
+	start := time.Now()
+	k.iterativeFindNode(context.Background(), NewRandomNodeID(), alpha)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected lookup to end at its deadline, took %s", elapsed)
+	}
+	if after := k.Stats().Contacts; after != before {
+		t.Errorf("Expected %d contacts to survive the deadline, found %d", before, after)
+	}
+
+	// Without a lookup deadline, the per-RPC timeout ends the lookup
+	k.RPCTimeout = 50 * time.Millisecond
+	k.LookupTimeout = time.Hour
+	start = time.Now()
+	k.iterativeFindNode(context.Background(), NewRandomNodeID(), alpha)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected lookup to end as its RPCs time out, took %s", elapsed)
+	}
+}
+
+func TestSimPartition(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newSimNodes(t, network, 40)
+	defer closeSimNodes(nodes)
+
+	var left, right []string
+	for i, k := range nodes {
+		if i%2 == 0 {
+			left = append(left, k.routes.node.address)
+		} else {
+			right = append(right, k.routes.node.address)
+		}
+	}
+	network.Partition(left, right)
+
+	ip := net.ParseIP("74.125.224.72")
+	register(t, nodes[0], "www.google.com")
+	if err := nodes[0].Put(context.Background(), testKey, "www.google.com", "A", Record{IP: ip}); err != nil {
+		t.Fatalf("Error putting www.google.com: %s", err)
+	}
+	if found, err := nodes[2].Get(context.Background(), "www.google.com", "A"); err != nil || !onlyIP(found).Equal(ip) {
+		t.Errorf("Expected %s on same side of partition, received %v (%v)", ip, found, err)
+	}
+	if found, err := nodes[1].Get(context.Background(), "www.google.com", "A"); err != ErrNotFound {
+		t.Errorf("Expected record to be unreachable across partition, received %v (%v)", found, err)
+	}
+
+	// Once healed, a node that rejoins through the other side finds the record
+	network.Heal()
+	if err := nodes[1].Join(context.Background(), nodes[0].routes.node); err != nil {
+		t.Fatalf("Error rejoining after partition: %s", err)
+	}
+	if found, err := nodes[1].Get(context.Background(), "www.google.com", "A"); err != nil || !onlyIP(found).Equal(ip) {
+		t.Errorf("Expected %s after healing partition, received %v (%v)", ip, found, err)
+	}
+}
+
+func TestSimForgedRecords(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newSimNodes(t, network, 10)
+	defer closeSimNodes(nodes)
+
+	register(t, nodes[0], "www.google.com")
+
+	// A node serving records that were changed after being signed
+	forged := signed("www.google.com", "A", Record{IP: net.ParseIP("74.125.224.72"), TTL: DefaultTTL})
+	forged.Records = []Record{{IP: net.ParseIP("10.0.0.1"), TTL: DefaultTTL}}
+	nodes[0].domains.mutex.Lock()
+	nodes[0].domains.put("www.google.com", "A", &domainRecord{forged, time.Now().Add(time.Hour), time.Now(), false})
+	nodes[0].domains.mutex.Unlock()
+
+	for i := 1; i < len(nodes); i++ {
+		if found, err := nodes[i].Get(context.Background(), "www.google.com", "A"); err != ErrNotFound {
+			t.Errorf("Node %d expected forged records to be discarded, received %v (%v)", i, found, err)
+		}
+	}
+}
+
+func TestSimConvergence(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newSimNodes(t, network, 20)
+	defer closeSimNodes(nodes)
+
+	register(t, nodes[0], "www.google.com")
+	if err := nodes[0].Put(context.Background(), testKey, "www.google.com", "A", Record{IP: net.ParseIP("74.125.224.72")}); err != nil {
+		t.Fatalf("Error putting www.google.com: %s", err)
+	}
+
+	// An update that only reached some of the replicas
+	ip := net.ParseIP("74.125.224.73")
+	update := signed("www.google.com", "A", Record{IP: ip, TTL: DefaultTTL})
+	for _, k := range nodes[2:] {
+		if err := k.domains.storeRecord("www.google.com", "A", update, time.Hour); err != nil {
+			t.Fatalf("Error storing update on %s: %s", k.routes.node.address, err)
+		}
+	}
+
+	for i, k := range nodes {
+		if found, err := k.Get(context.Background(), "www.google.com", "A"); err != nil || !onlyIP(found).Equal(ip) {
+			t.Errorf("Node %d expected newest record %s, received %v (%v)", i, ip, found, err)
+		}
+	}
+	for i, k := range nodes {
+		if held := k.domains.retrieve("www.google.com", "A"); held.Sequence != update.Sequence {
+			t.Errorf("Node %d expected to hold version %d after lookups, found %d", i, update.Sequence, held.Sequence)
+		}
+	}
+}
+
+func TestSimDelete(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newSimNodes(t, network, 20)
+	defer closeSimNodes(nodes)
+
+	ip := net.ParseIP("74.125.224.72")
+	register(t, nodes[0], "www.google.com")
+	for _, typ := range []string{"A", "TXT", "MX"} {
+		record := map[string]Record{"A": {IP: ip}, "TXT": {Text: []string{"v=spf1 -all"}}, "MX": {Host: "mail.google.com"}}[typ]
+		if err := nodes[0].Put(context.Background(), testKey, "www.google.com", typ, record); err != nil {
+			t.Fatalf("Error putting %s records: %s", typ, err)
+		}
+	}
+
+	// Deletion is done by whoever holds the key, not only the publisher
+	if err := nodes[5].Delete(context.Background(), testKey, "www.google.com", "TXT"); err != nil {
+		t.Fatalf("Error deleting TXT records: %s", err)
+	}
+	for i, k := range nodes {
+		if found, err := k.Get(context.Background(), "www.google.com", "TXT"); err != ErrNotFound {
+			t.Errorf("Node %d expected deleted TXT records to be gone, received %v (%v)", i, found, err)
+		}
+		if found, err := k.Get(context.Background(), "www.google.com", "A"); err != nil || !onlyIP(found).Equal(ip) {
+			t.Errorf("Node %d expected %s for www.google.com, received %v (%v)", i, ip, found, err)
+		}
+	}
+
+	_, other, _ := ed25519.GenerateKey(nil)
+	if err := nodes[5].Delete(context.Background(), other, "www.google.com"); err != ErrNotOwner {
+		t.Errorf("Expected ErrNotOwner deleting another key's name, received %v", err)
+	}
+	if err := nodes[5].Delete(context.Background(), testKey, "www.google.com"); err != nil {
+		t.Fatalf("Error deleting www.google.com: %s", err)
+	}
+	for i, k := range nodes {
+		for _, typ := range []string{"A", "MX"} {
+			if found, err := k.Get(context.Background(), "www.google.com", typ); err != ErrNotFound {
+				t.Errorf("Node %d expected deleted %s records to be gone, received %v (%v)", i, typ, found, err)
+			}
+		}
+	}
+
+	// The publisher can put the records back, superseding the tombstone
+	if err := nodes[0].Put(context.Background(), testKey, "www.google.com", "A", Record{IP: ip}); err != nil {
+		t.Fatalf("Error putting records back: %s", err)
+	}
+	if found, err := nodes[10].Get(context.Background(), "www.google.com", "A"); err != nil || !onlyIP(found).Equal(ip) {
+		t.Errorf("Expected %s for www.google.com after putting it back, received %v (%v)", ip, found, err)
+	}
+}
+
+func TestSimDeleteFarPublisher(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newSimNodes(t, network, 30)
+	defer closeSimNodes(nodes)
+
+	// The publisher is the node furthest from the key, well outside the
+	// closest nodes that the tombstone is stored on
+	target := nodes[0].domainKey("www.google.com", "A")
+	sorted := append([]*Kademlia(nil), nodes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].routes.node.id.Xor(target).Less(sorted[j].routes.node.id.Xor(target))
+	})
+	publisher, deleter := sorted[len(sorted)-1], sorted[0]
+
+	// The registration must outlast every republish below
+	if err := publisher.Register(context.Background(), testKey, "www.google.com", 4*republishInterval); err != nil {
+		t.Fatalf("Error registering www.google.com: %s", err)
+	}
+	if err := publisher.Put(context.Background(), testKey, "www.google.com", "A", Record{IP: net.ParseIP("74.125.224.72")}); err != nil {
+		t.Fatalf("Error putting www.google.com: %s", err)
+	}
+	if err := deleter.Delete(context.Background(), testKey, "www.google.com", "A"); err != nil {
+		t.Fatalf("Error deleting www.google.com: %s", err)
+	}
+	if held := publisher.domains.retrieve("www.google.com", "A"); held.Deleted {
+		t.Fatalf("Expected the publisher not to be sent the tombstone")
+	}
+
+	// The publisher finds the tombstone when it next republishes, so its set
+	// does not come back once the tombstone is forgotten
+	now := time.Now()
+	publisher.republish(context.Background(), now.Add(republishInterval))
+	later := now.Add(tombstoneGracePeriod + time.Minute)
+	for _, k := range nodes {
+		k.domains.expire(later)
+	}
+	publisher.republish(context.Background(), later)
+	for i, k := range nodes {
+		if found, err := k.Get(context.Background(), "www.google.com", "A"); err != ErrNotFound {
+			t.Errorf("Node %d expected deleted records to stay gone, received %v (%v)", i, found, err)
+		}
+	}
+}
+
+func TestSimRegistration(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newSimNodes(t, network, 20)
+	defer closeSimNodes(nodes)
+
+	ip := net.ParseIP("74.125.224.72")
+	register(t, nodes[0], "www.google.com")
+	if err := nodes[0].Put(context.Background(), testKey, "www.google.com", "A", Record{IP: ip}); err != nil {
+		t.Fatalf("Error putting www.google.com: %s", err)
+	}
+
+	// The first claim wins, so another key can neither register the name
+	// nor publish records for it
+	_, other, _ := ed25519.GenerateKey(nil)
+	if err := nodes[5].Register(context.Background(), other, "www.google.com", time.Hour); err != ErrNotOwner {
+		t.Errorf("Expected ErrNotOwner registering a claimed name, received %v", err)
+	}
+	if err := nodes[5].Put(context.Background(), other, "www.google.com", "AAAA", Record{IP: net.ParseIP("::1")}); err != ErrNotOwner {
+		t.Errorf("Expected ErrNotOwner putting records for a claimed name, received %v", err)
+	}
+	if err := nodes[5].Put(context.Background(), other, "www.facebook.com", "A", Record{IP: ip}); err != ErrNotRegistered {
+		t.Errorf("Expected ErrNotRegistered putting records for an unclaimed name, received %v", err)
+	}
+
+	// A later claim that reached some replicas anyway loses to the first,
+	// even with a newer version
+	late := NewRegistration(other, "www.google.com", nextSequence(0), time.Now().Add(time.Second), time.Now().Add(time.Hour), testDifficulty)
+	for _, i := range []int{5, 6, 7} {
+		nodes[i].domains.mutex.Lock()
+		nodes[i].domains.put("www.google.com", RegistrationType, &domainRecord{late, time.Now().Add(time.Hour), time.Now(), false})
+		nodes[i].domains.mutex.Unlock()
+	}
+	for i := range nodes {
+		if found, err := nodes[i].Registration(context.Background(), "www.google.com"); err != nil || !found.Owner.Equal(testKey.Public()) {
+			t.Errorf("Node %d expected the first claim on www.google.com, received %v (%v)", i, found.Owner, err)
+		}
+	}
+
+	// Records signed by anyone but the registered owner are ignored
+	hijack := SignRecords(other, "www.google.com", "AAAA", nextSequence(0), []Record{{IP: net.ParseIP("::1"), TTL: DefaultTTL}})
+	nodes[5].domains.mutex.Lock()
+	nodes[5].domains.put("www.google.com", "AAAA", &domainRecord{hijack, time.Now().Add(time.Hour), time.Now(), false})
+	nodes[5].domains.mutex.Unlock()
+	for i := range nodes {
+		if found, err := nodes[i].Get(context.Background(), "www.google.com", "A"); err != nil || !onlyIP(found).Equal(ip) {
+			t.Errorf("Node %d expected %s for www.google.com, received %v (%v)", i, ip, found, err)
+		}
+		if found, err := nodes[i].Get(context.Background(), "www.google.com", "AAAA"); err != ErrNotFound {
+			t.Errorf("Node %d expected hijacked records to be ignored, received %v (%v)", i, found, err)
+		}
+	}
+}
+
+func TestSimBackdatedRegistration(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := newSimNodes(t, network, 20)
+	defer closeSimNodes(nodes)
+
+	ip := net.ParseIP("74.125.224.72")
+	register(t, nodes[0], "www.google.com")
+	if err := nodes[0].Put(context.Background(), testKey, "www.google.com", "A", Record{IP: ip}); err != nil {
+		t.Fatalf("Error putting www.google.com: %s", err)
+	}
+
+	// Another key claiming to have registered the name long before is
+	// refused by every replica, whether or not it holds the first claim
+	_, other, _ := ed25519.GenerateKey(nil)
+	backdated := NewRegistration(other, "www.google.com", nextSequence(0), time.Unix(1, 0), time.Now().Add(time.Hour), testDifficulty)
+	for i := 1; i < len(nodes); i++ {
+		if err := nodes[5].sendstoreQuery(context.Background(), &nodes[i].routes.node, "www.google.com", RegistrationType, backdated, nil, time.Hour); err == nil {
+			t.Errorf("Node %d accepted a backdated claim", i)
+		}
+	}
+	for i := range nodes {
+		if found, err := nodes[i].Registration(context.Background(), "www.google.com"); err != nil || !found.Owner.Equal(testKey.Public()) {
+			t.Errorf("Node %d expected the first claim on www.google.com, received %v (%v)", i, found.Owner, err)
+		}
+		if found, err := nodes[i].Get(context.Background(), "www.google.com", "A"); err != nil || !onlyIP(found).Equal(ip) {
+			t.Errorf("Node %d expected %s for www.google.com, received %v (%v)", i, ip, found, err)
+		}
+	}
+}
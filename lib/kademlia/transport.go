@@ -0,0 +1,453 @@
+package kademlia
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Transport carries RPCs between Kademlia nodes.
+type Transport interface {
+	// Listen starts delivering RPCs sent to address to handler.
+	Listen(address string, handler Handler) error
+
+	// Call sends an RPC such as "kademliaCore.Ping" to the node at address
+	// and decodes its reply, blocking until the reply arrives, the call fails
+	// or ctx is done.  Errors returned by the remote handler are RemoteErrors.
+	Call(ctx context.Context, address string, method string, args, reply interface{}) error
+
+	// Close stops listening and releases the transport's connections.
+	Close() error
+}
+
+// RemoteError is returned by Transport.Call when the remote node answered
+// with an error, as opposed to not answering at all.
+type RemoteError string
+
+func (e RemoteError) Error() string {
+	return string(e)
+}
+
+// Handler serves the RPCs a Transport receives.
+type Handler interface {
+	Ping(args *PingRequest, response *PingResponse) error
+	Store(args *StoreRequest, response *StoreResponse) error
+	FindNode(args *FindNodeRequest, response *FindNodeResponse) error
+	FindValue(args *FindValueRequest, response *FindValueResponse) error
+}
+
+// rpcMethod decodes the arguments for an RPC and serves it with a Handler.
+type rpcMethod func(handler Handler, decode func(args interface{}) error) (reply interface{}, err error)
+
+// rpcMethods holds every RPC a Handler serves, for transports that decode
+// requests themselves rather than through net/rpc.
+var rpcMethods = map[string]rpcMethod{
+	"kademliaCore.Ping": func(handler Handler, decode func(interface{}) error) (interface{}, error) {
+		args, reply := new(PingRequest), new(PingResponse)
+		if err := decode(args); err != nil {
+			return nil, err
+		}
+		return reply, handler.Ping(args, reply)
+	},
+	"kademliaCore.Store": func(handler Handler, decode func(interface{}) error) (interface{}, error) {
+		args, reply := new(StoreRequest), new(StoreResponse)
+		if err := decode(args); err != nil {
+			return nil, err
+		}
+		return reply, handler.Store(args, reply)
+	},
+	"kademliaCore.FindNode": func(handler Handler, decode func(interface{}) error) (interface{}, error) {
+		args, reply := new(FindNodeRequest), new(FindNodeResponse)
+		if err := decode(args); err != nil {
+			return nil, err
+		}
+		return reply, handler.FindNode(args, reply)
+	},
+	"kademliaCore.FindValue": func(handler Handler, decode func(interface{}) error) (interface{}, error) {
+		args, reply := new(FindValueRequest), new(FindValueResponse)
+		if err := decode(args); err != nil {
+			return nil, err
+		}
+		return reply, handler.FindValue(args, reply)
+	},
+}
+
+// dispatch serves a single RPC with handler, returning the reply to send back.
+func dispatch(handler Handler, method string, decode func(args interface{}) error) (interface{}, error) {
+	serve, ok := rpcMethods[method]
+	if !ok {
+		return nil, fmt.Errorf("Unknown RPC method %s", method)
+	}
+	return serve(handler, decode)
+}
+
+// Defaults for RPCTransport
+const (
+	rpcIdleTimeout = 90 * time.Second // before an unused connection is closed
+	rpcMaxConns    = 128              // connections open to peers at once
+)
+
+// RPCTransport carries RPCs over HTTP with net/rpc.  Connections to peers
+// are kept open and shared by every call made to the same peer until they
+// go unused for IdleTimeout.  Pooled connections are not checked while they
+// sit idle: one the peer has hung up on is only found when a call over it
+// fails, and is then dropped from the pool so that the call, or the next one
+// to the peer, dials a new one.  The zero value is ready to use.
+type RPCTransport struct {
+	// IdleTimeout is how long a connection to a peer stays open unused.  If
+	// it is not positive, idle connections stay open until they fail or are
+	// evicted to make room under MaxConns.
+	IdleTimeout time.Duration
+
+	// MaxConns limits how many connections to peers are open at once, 128
+	// if it is not positive.  Once it is reached, the least recently used
+	// idle connection is closed to make room for a new one; if none are
+	// idle, calls to other peers wait for one to become idle or for their
+	// context to be done.
+	MaxConns int
+
+	mutex    sync.Mutex
+	listener *rpcListener
+	clients  map[string]*pooledClient
+	open     int           // connections open, pooled or not, or being dialed
+	freed    chan struct{} // closed when a connection is closed or goes idle, nil if no call is waiting
+	stop     chan struct{} // closed to stop the reaper, nil if it is not running
+}
+
+// pooledClient is an open connection to a peer.
+type pooledClient struct {
+	client   *rpc.Client
+	address  string
+	calls    int // calls in flight
+	lastUsed time.Time
+	pooled   bool // false once dropped, after which it closes when its calls are done
+}
+
+// NewRPCTransport creates a net/rpc transport with the default connection
+// limits.
+func NewRPCTransport() *RPCTransport {
+	return &RPCTransport{
+		IdleTimeout: rpcIdleTimeout,
+		MaxConns:    rpcMaxConns,
+	}
+}
+
+// maxConns returns MaxConns, or the default if it is not positive.
+func (t *RPCTransport) maxConns() int {
+	if t.MaxConns <= 0 {
+		return rpcMaxConns
+	}
+	return t.MaxConns
+}
+
+// Listen serves handler over HTTP on the TCP address.
+func (t *RPCTransport) Listen(address string, handler Handler) (err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.listener != nil {
+		return fmt.Errorf("Already listening on %s", t.listener.Addr())
+	}
+
+	server := rpc.NewServer()
+	if err = server.RegisterName("kademliaCore", handler); err != nil {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	listener, err := net.Listen("tcp", address)
+	if err == nil {
+		t.listener = &rpcListener{Listener: listener, conns: make(map[*servedConn]bool)}
+		go http.Serve(t.listener, mux)
+	}
+	return
+}
+
+// Call sends a single RPC to the node at address over its pooled connection,
+// dialing one if needed, and gives up when ctx is done.  A pooled connection
+// found broken is redialed once within the same call.
+func (t *RPCTransport) Call(ctx context.Context, address string, method string, args, reply interface{}) error {
+	for attempt := 0; ; attempt++ {
+		c, reused, err := t.get(ctx, address)
+		if err != nil {
+			return err
+		}
+		// A call given up on may still be answered later, so the reply is
+		// decoded into a copy that is only handed over once complete
+		decoded := reflect.New(reflect.TypeOf(reply).Elem())
+		select {
+		case call := <-c.client.Go(method, args, decoded.Interface(), make(chan *rpc.Call, 1)).Done:
+			if err = call.Error; err == nil {
+				reflect.ValueOf(reply).Elem().Set(decoded.Elem())
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		t.release(c, err)
+
+		// The peer may have hung up on a pooled connection while it sat
+		// idle; every RPC is safe to repeat, so try once more on a new one
+		if _, remote := err.(rpc.ServerError); err != nil && !remote && reused && attempt == 0 && ctx.Err() == nil {
+			continue
+		}
+		if serverErr, ok := err.(rpc.ServerError); ok {
+			err = RemoteError(serverErr)
+		}
+		return err
+	}
+}
+
+// get returns a connection to address for one call, reusing the pooled one
+// if there is one, or waiting for room under MaxConns to dial a new one.
+func (t *RPCTransport) get(ctx context.Context, address string) (c *pooledClient, reused bool, err error) {
+	for {
+		t.mutex.Lock()
+		if c = t.clients[address]; c != nil {
+			c.calls++
+			t.mutex.Unlock()
+			return c, true, nil
+		}
+		if t.open < t.maxConns() || t.evict() {
+			t.open++
+			t.mutex.Unlock()
+			break
+		}
+		if t.freed == nil {
+			t.freed = make(chan struct{})
+		}
+		freed := t.freed
+		t.mutex.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+
+	client, err := dialHTTP(ctx, address)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err != nil {
+		t.closed()
+		return
+	}
+	if c = t.clients[address]; c != nil {
+		// Another call connected while we were dialing
+		client.Close()
+		t.closed()
+		c.calls++
+		return c, false, nil
+	}
+	c = &pooledClient{client: client, address: address, calls: 1, lastUsed: time.Now(), pooled: true}
+	if t.clients == nil {
+		t.clients = make(map[string]*pooledClient)
+	}
+	t.clients[address] = c
+	if t.stop == nil && t.IdleTimeout > 0 {
+		t.stop = make(chan struct{})
+		go t.reap(t.stop)
+	}
+	return c, false, nil
+}
+
+// release ends a call made over c, dropping the connection if the call
+// failed for any reason other than the peer returning an error or the caller
+// no longer wanting the reply.
+func (t *RPCTransport) release(c *pooledClient, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	c.calls--
+	c.lastUsed = time.Now()
+	if _, remote := err.(rpc.ServerError); err != nil && !remote && err != context.Canceled {
+		t.drop(c)
+	}
+	if c.calls == 0 {
+		if !c.pooled {
+			t.close(c)
+		} else {
+			t.wake()
+		}
+	}
+}
+
+// drop removes c from the pool.  The caller must hold the mutex.
+func (t *RPCTransport) drop(c *pooledClient) {
+	if c.pooled {
+		delete(t.clients, c.address)
+		c.pooled = false
+	}
+}
+
+// evict closes the least recently used idle connection, reporting whether
+// there was one.  The caller must hold the mutex.
+func (t *RPCTransport) evict() bool {
+	var oldest *pooledClient
+	for _, c := range t.clients {
+		if c.calls == 0 && (oldest == nil || c.lastUsed.Before(oldest.lastUsed)) {
+			oldest = c
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	t.drop(oldest)
+	t.close(oldest)
+	return true
+}
+
+// close closes the connection of a client no longer in the pool.  The caller
+// must hold the mutex.
+func (t *RPCTransport) close(c *pooledClient) {
+	c.client.Close()
+	t.closed()
+}
+
+// closed counts a connection as no longer open.  The caller must hold the
+// mutex.
+func (t *RPCTransport) closed() {
+	t.open--
+	t.wake()
+}
+
+// wake lets the calls waiting for room under MaxConns try again.  The caller
+// must hold the mutex.
+func (t *RPCTransport) wake() {
+	if t.freed != nil {
+		close(t.freed)
+		t.freed = nil
+	}
+}
+
+// reap closes connections that have gone unused for IdleTimeout, stopping
+// once the pool is empty.
+func (t *RPCTransport) reap(stop chan struct{}) {
+	ticker := time.NewTicker(t.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			t.mutex.Lock()
+			for _, c := range t.clients {
+				if c.calls == 0 && now.Sub(c.lastUsed) >= t.IdleTimeout {
+					t.drop(c)
+					t.close(c)
+				}
+			}
+			if len(t.clients) == 0 {
+				close(t.stop)
+				t.stop = nil
+				t.mutex.Unlock()
+				return
+			}
+			t.mutex.Unlock()
+		}
+	}
+}
+
+// dialHTTP connects to a net/rpc server over HTTP as rpc.DialHTTP does, but
+// within ctx's deadline.
+func dialHTTP(ctx context.Context, address string) (*rpc.Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = fmt.Errorf("Unexpected HTTP response: %s", resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The connection outlives this call's deadline in the pool
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
+
+// Close stops listening for RPCs, hanging up on the peers connected to us,
+// and closes the connections to peers.
+func (t *RPCTransport) Close() (err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.listener != nil {
+		err = t.listener.Close()
+		t.listener = nil
+	}
+	for _, c := range t.clients {
+		t.drop(c)
+		if c.calls == 0 {
+			t.close(c)
+		}
+	}
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+	}
+	return
+}
+
+// rpcListener keeps track of the connections it accepts, so that closing it
+// closes them too; otherwise peers holding pooled connections would go on
+// reaching a node after it stopped listening.
+type rpcListener struct {
+	net.Listener
+	mutex sync.Mutex
+	conns map[*servedConn]bool
+}
+
+// servedConn is a connection accepted by an rpcListener.
+type servedConn struct {
+	net.Conn
+	listener *rpcListener
+}
+
+func (l *rpcListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	served := &servedConn{conn, l}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conns == nil {
+		conn.Close()
+		return nil, net.ErrClosed
+	}
+	l.conns[served] = true
+	return served, nil
+}
+
+func (l *rpcListener) Close() error {
+	err := l.Listener.Close()
+	l.mutex.Lock()
+	conns := l.conns
+	l.conns = nil
+	l.mutex.Unlock()
+	for conn := range conns {
+		conn.Conn.Close()
+	}
+	return err
+}
+
+func (c *servedConn) Close() error {
+	c.listener.mutex.Lock()
+	delete(c.listener.conns, c)
+	c.listener.mutex.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,232 @@
+package kademlia
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestRPCTransport(t *testing.T) {
+	k := newTestNode("127.0.0.1:9060")
+	me := k.routes.node
+	transport := NewRPCTransport()
+	if err := transport.Listen(me.address, &kademliaCore{k}); err != nil {
+		t.Fatalf("Error listening on %s: %s", me.address, err)
+	}
+	defer transport.Close()
+
+	if err := transport.Listen(me.address, &kademliaCore{k}); err == nil {
+		t.Errorf("Expected error listening twice")
+	}
+
+	someone := newTestNode("127.0.0.1:9061")
+	reply := PingResponse{}
+	if err := transport.Call(context.Background(), me.address, "kademliaCore.Ping", &PingRequest{someone.newHeader()}, &reply); err != nil {
+		t.Fatalf("Error on ping: %s", err)
+	}
+	if !reply.Sender.id.Equals(me.id) {
+		t.Errorf("Expected reply from %s, received %s", me.id, reply.Sender.id)
+	}
+
+	someone.NetworkID = "other"
+	err := transport.Call(context.Background(), me.address, "kademliaCore.Ping", &PingRequest{someone.newHeader()}, &reply)
+	if _, ok := err.(RemoteError); !ok {
+		t.Errorf("Expected remote error pinging across network IDs, received %v", err)
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	k := newTestNode("127.0.0.1:9062")
+	sender := newTestNode("127.0.0.1:9063")
+	someone := sender.routes.node
+
+	reply, err := dispatch(&kademliaCore{k}, "kademliaCore.FindNode", func(args interface{}) error {
+		*args.(*FindNodeRequest) = FindNodeRequest{sender.newHeader(), someone.id}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error dispatching FindNode: %s", err)
+	}
+	if contacts := reply.(*FindNodeResponse).Contacts; len(contacts) != 1 || !contacts[0].id.Equals(someone.id) {
+		t.Errorf("Expected FindNode to return the sender, received %v", contacts)
+	}
+
+	if _, err := dispatch(&kademliaCore{k}, "kademliaCore.Missing", nil); err == nil {
+		t.Errorf("Expected error dispatching unknown method")
+	}
+}
+
+func TestRPCTransportTimeout(t *testing.T) {
+	// A peer that accepts connections but never answers them
+	listener, err := net.Listen("tcp", "127.0.0.1:9064")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	transport := NewRPCTransport()
+	defer transport.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	someone := newTestNode("127.0.0.1:9065")
+	err = transport.Call(ctx, listener.Addr().String(), "kademliaCore.Ping", &PingRequest{someone.newHeader()}, &PingResponse{})
+	if err == nil {
+		t.Fatalf("Expected ping to a silent peer to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected ping to give up with its context, took %s", elapsed)
+	}
+}
+
+func TestRPCTransportPool(t *testing.T) {
+	var servers [2]*RPCTransport
+	for i := range servers {
+		address := fmt.Sprintf("127.0.0.1:%d", 9066+i)
+		servers[i] = NewRPCTransport()
+		if err := servers[i].Listen(address, &kademliaCore{newTestNode(address)}); err != nil {
+			t.Fatalf("Error listening on %s: %s", address, err)
+		}
+		defer servers[i].Close()
+	}
+	a, b := servers[0].listener.Addr().String(), servers[1].listener.Addr().String()
+
+	transport := NewRPCTransport()
+	transport.MaxConns = 1
+	transport.IdleTimeout = 100 * time.Millisecond
+	defer transport.Close()
+	someone := newTestNode("127.0.0.1:9068")
+	ping := func(address string) {
+		if err := transport.Call(context.Background(), address, "kademliaCore.Ping", &PingRequest{someone.newHeader()}, &PingResponse{}); err != nil {
+			t.Fatalf("Error pinging %s: %s", address, err)
+		}
+	}
+
+	// Calls to the same peer share a connection
+	ping(a)
+	first := transport.clients[a]
+	ping(a)
+	if len(transport.clients) != 1 || transport.clients[a] != first {
+		t.Errorf("Expected both calls to %s to share a connection, found %v", a, transport.clients)
+	}
+
+	// A new peer past MaxConns takes the place of the idle one
+	ping(b)
+	if len(transport.clients) != 1 || transport.clients[b] == nil {
+		t.Errorf("Expected only a connection to %s, found %v", b, transport.clients)
+	}
+	if err := first.client.Call("kademliaCore.Ping", &PingRequest{}, &PingResponse{}); err != rpc.ErrShutdown {
+		t.Errorf("Expected the evicted connection to be closed, received %v", err)
+	}
+
+	// A peer that restarts is redialed without the call failing
+	servers[1].Close()
+	if err := servers[1].Listen(b, &kademliaCore{newTestNode(b)}); err != nil {
+		t.Fatalf("Error listening on %s again: %s", b, err)
+	}
+	ping(b)
+
+	// Idle connections are closed, after which the reaper stops
+	time.Sleep(4 * transport.IdleTimeout)
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if len(transport.clients) != 0 || transport.open != 0 || transport.stop != nil {
+		t.Errorf("Expected idle connections to be closed, found %v", transport.clients)
+	}
+}
+
+func TestRPCTransportZeroValue(t *testing.T) {
+	server := NewRPCTransport()
+	if err := server.Listen("127.0.0.1:9072", &kademliaCore{newTestNode("127.0.0.1:9072")}); err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer server.Close()
+
+	// With no limits set, calls go through under the default MaxConns and
+	// idle connections are kept rather than reaped
+	transport := &RPCTransport{}
+	defer transport.Close()
+	someone := newTestNode("127.0.0.1:9073")
+	if err := transport.Call(context.Background(), "127.0.0.1:9072", "kademliaCore.Ping", &PingRequest{someone.newHeader()}, &PingResponse{}); err != nil {
+		t.Fatalf("Error pinging: %s", err)
+	}
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if len(transport.clients) != 1 || transport.stop != nil {
+		t.Errorf("Expected one pooled connection and no reaper, found %v", transport.clients)
+	}
+}
+
+func TestRPCTransportLimit(t *testing.T) {
+	// A peer that accepts connections but never answers them, and one that does
+	silent, err := net.Listen("tcp", "127.0.0.1:9069")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	server := NewRPCTransport()
+	if err := server.Listen("127.0.0.1:9070", &kademliaCore{newTestNode("127.0.0.1:9070")}); err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer server.Close()
+
+	transport := NewRPCTransport()
+	transport.MaxConns = 1
+	defer transport.Close()
+	someone := newTestNode("127.0.0.1:9071")
+	ping := func(ctx context.Context, address string) error {
+		return transport.Call(ctx, address, "kademliaCore.Ping", &PingRequest{someone.newHeader()}, &PingResponse{})
+	}
+
+	// While the only connection is busy, calls to other peers wait for it
+	busy, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- ping(busy, silent.Addr().String())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancelWait := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelWait()
+	if err := ping(ctx, "127.0.0.1:9070"); err != context.DeadlineExceeded {
+		t.Errorf("Expected a call past MaxConns to wait out its context, received %v", err)
+	}
+	transport.mutex.Lock()
+	if transport.open != 1 {
+		t.Errorf("Expected 1 open connection, found %d", transport.open)
+	}
+	transport.mutex.Unlock()
+
+	// Once the busy call is done its connection makes room
+	go func() {
+		done <- ping(context.Background(), "127.0.0.1:9070")
+	}()
+	if err := <-done; err == nil {
+		t.Errorf("Expected ping to the silent peer to fail")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Error pinging once there was room: %s", err)
+	}
+}
@@ -0,0 +1,280 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Defaults for UDPTransport
+const (
+	udpTimeout    = 2 * time.Second
+	udpRetries    = 2
+	maxPacketSize = 65507 // largest UDP payload over IPv4
+)
+
+// udpPacket is the datagram exchanged by UDPTransport, carrying one gob
+// encoded request or reply matched up by its ID.
+type udpPacket struct {
+	ID     uint64
+	Method string
+	Reply  bool
+	Error  string
+	Body   []byte
+}
+
+// UDPTransport carries each RPC as a single datagram, retrying requests that
+// go unanswered.  Requests and replies are matched by ID and by the address
+// the request went to, so one socket serves any number of calls at once.
+type UDPTransport struct {
+	// Timeout is the longest to wait for a reply before resending a request.
+	// Calls with a deadline wait less, so that every resend fits in it.
+	Timeout time.Duration
+
+	// Retries is how many times an unanswered request is resent.
+	Retries int
+
+	mutex     sync.Mutex
+	conn      *net.UDPConn
+	listening bool
+	closed    chan struct{}
+	pending   map[uint64]*udpCall
+	nextID    uint64
+}
+
+// udpCall is a request waiting on its reply.
+type udpCall struct {
+	addr *net.UDPAddr
+	done chan *udpPacket
+}
+
+// NewUDPTransport creates a UDP transport with the default timeout and retries.
+func NewUDPTransport() *UDPTransport {
+	return &UDPTransport{
+		Timeout: udpTimeout,
+		Retries: udpRetries,
+		pending: make(map[uint64]*udpCall),
+		nextID:  uint64(rand.Int63()),
+	}
+}
+
+// Listen serves handler on the UDP address.  Calls made afterwards are sent
+// from the same socket.
+func (t *UDPTransport) Listen(address string, handler Handler) (err error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.listening {
+		return fmt.Errorf("Already listening on %s", t.conn.LocalAddr())
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return
+	}
+	t.open(conn, handler)
+	t.listening = true
+	return
+}
+
+// open switches the transport to conn, closing any socket opened for earlier
+// calls; the transport must already be locked.
+func (t *UDPTransport) open(conn *net.UDPConn, handler Handler) {
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	if t.closed == nil {
+		t.closed = make(chan struct{})
+	}
+	t.conn = conn
+	go t.read(conn, handler)
+}
+
+// Call sends an RPC to the UDP address, resending it up to Retries times
+// when no reply arrives in time, until ctx is done.  Each send waits for
+// Timeout or an even share of what is left until ctx's deadline, whichever is
+// shorter.
+func (t *UDPTransport) Call(ctx context.Context, address string, method string, args, reply interface{}) (err error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return
+	}
+	var body bytes.Buffer
+	if err = gob.NewEncoder(&body).Encode(args); err != nil {
+		return
+	}
+
+	id, done, closed, err := t.register(addr)
+	if err != nil {
+		return
+	}
+	defer t.unregister(id)
+
+	request := &udpPacket{ID: id, Method: method, Body: body.Bytes()}
+	for attempt := 0; attempt <= t.Retries; attempt++ {
+		if err = t.send(addr, request); err != nil {
+			return
+		}
+
+		wait := t.Timeout
+		if deadline, ok := ctx.Deadline(); ok {
+			if share := time.Until(deadline) / time.Duration(t.Retries+1-attempt); share < wait {
+				wait = share
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case response := <-done:
+			timer.Stop()
+			if response.Error != "" {
+				return RemoteError(response.Error)
+			}
+			return gob.NewDecoder(bytes.NewReader(response.Body)).Decode(reply)
+		case <-closed:
+			timer.Stop()
+			return fmt.Errorf("Transport closed during %s to %s", method, address)
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return fmt.Errorf("No reply to %s from %s after %d attempts", method, address, t.Retries+1)
+}
+
+// register allocates the ID of a request to addr and the channel its reply
+// is delivered on, opening a socket for outgoing calls if the transport is
+// not listening.
+func (t *UDPTransport) register(addr *net.UDPAddr) (id uint64, done chan *udpPacket, closed chan struct{}, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.conn == nil {
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		t.open(conn, nil)
+	}
+
+	t.nextID++
+	id = t.nextID
+	done = make(chan *udpPacket, 1)
+	t.pending[id] = &udpCall{addr, done}
+	return id, done, t.closed, nil
+}
+
+func (t *UDPTransport) unregister(id uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.pending, id)
+}
+
+func (t *UDPTransport) send(addr *net.UDPAddr, packet *udpPacket) (err error) {
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(packet); err != nil {
+		return
+	}
+	if buf.Len() > maxPacketSize {
+		return fmt.Errorf("RPC of %d bytes does not fit in a datagram", buf.Len())
+	}
+
+	t.mutex.Lock()
+	conn := t.conn
+	t.mutex.Unlock()
+	if conn == nil {
+		return fmt.Errorf("Transport closed")
+	}
+	_, err = conn.WriteToUDP(buf.Bytes(), addr)
+	return
+}
+
+// read receives datagrams on conn until it is closed, handing replies to the
+// calls waiting on them and serving requests with handler.
+func (t *UDPTransport) read(conn *net.UDPConn, handler Handler) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error reading from %s: %s\n", conn.LocalAddr(), err)
+			}
+			return
+		}
+
+		packet := new(udpPacket)
+		if err := gob.NewDecoder(bytes.NewReader(buf[:n])).Decode(packet); err != nil {
+			log.Printf("Dropping malformed packet from %s: %s\n", addr, err)
+			continue
+		}
+
+		if packet.Reply {
+			t.deliver(addr, packet)
+		} else if handler != nil {
+			go t.serve(addr, handler, packet)
+		}
+	}
+}
+
+// deliver hands a reply from addr to the call waiting on it; duplicate
+// replies to resent requests, and replies from anywhere but the address the
+// request went to, are dropped.
+func (t *UDPTransport) deliver(addr *net.UDPAddr, packet *udpPacket) {
+	t.mutex.Lock()
+	call := t.pending[packet.ID]
+	t.mutex.Unlock()
+	if call == nil {
+		return
+	}
+	if !call.addr.IP.Equal(addr.IP) || call.addr.Port != addr.Port {
+		log.Printf("Dropping reply to %s from %s, sent to %s\n", packet.Method, addr, call.addr)
+		return
+	}
+	select {
+	case call.done <- packet:
+	default:
+	}
+}
+
+func (t *UDPTransport) serve(addr *net.UDPAddr, handler Handler, request *udpPacket) {
+	response := &udpPacket{ID: request.ID, Method: request.Method, Reply: true}
+	reply, err := dispatch(handler, request.Method, func(args interface{}) error {
+		return gob.NewDecoder(bytes.NewReader(request.Body)).Decode(args)
+	})
+	if err == nil {
+		var body bytes.Buffer
+		err = gob.NewEncoder(&body).Encode(reply)
+		response.Body = body.Bytes()
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	if err := t.send(addr, response); err != nil {
+		log.Printf("Error replying to %s from %s: %s\n", request.Method, addr, err)
+	}
+}
+
+// Close stops listening and fails any calls still waiting on a reply.
+func (t *UDPTransport) Close() (err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.conn != nil {
+		err = t.conn.Close()
+		t.conn = nil
+		t.listening = false
+		close(t.closed)
+		t.closed = nil
+	}
+	return
+}
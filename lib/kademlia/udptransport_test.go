@@ -0,0 +1,172 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPTransport(t *testing.T) {
+	k := newTestNode("127.0.0.1:9070")
+	me := k.routes.node
+	server := NewUDPTransport()
+	if err := server.Listen(me.address, &kademliaCore{k}); err != nil {
+		t.Fatalf("Error listening on %s: %s", me.address, err)
+	}
+	defer server.Close()
+
+	if err := server.Listen(me.address, &kademliaCore{k}); err == nil {
+		t.Errorf("Expected error listening twice")
+	}
+
+	client := NewUDPTransport()
+	defer client.Close()
+
+	someone := newTestNode("127.0.0.1:9071")
+	reply := PingResponse{}
+	if err := client.Call(context.Background(), me.address, "kademliaCore.Ping", &PingRequest{someone.newHeader()}, &reply); err != nil {
+		t.Fatalf("Error on ping: %s", err)
+	}
+	if !reply.Sender.id.Equals(me.id) {
+		t.Errorf("Expected reply from %s, received %s", me.id, reply.Sender.id)
+	}
+
+	someone.NetworkID = "other"
+	err := client.Call(context.Background(), me.address, "kademliaCore.Ping", &PingRequest{someone.newHeader()}, &reply)
+	if _, ok := err.(RemoteError); !ok {
+		t.Errorf("Expected remote error pinging across network IDs, received %v", err)
+	}
+	if err := client.Call(context.Background(), me.address, "kademliaCore.Missing", &PingRequest{}, &reply); err == nil {
+		t.Errorf("Expected error calling unknown method")
+	}
+}
+
+func TestUDPTransportRetry(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A peer that loses the first copy of every request
+	k := newTestNode(conn.LocalAddr().String())
+	me := k.routes.node
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for seen := 0; ; seen++ {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if seen%2 == 0 {
+				continue
+			}
+			var request udpPacket
+			gob.NewDecoder(bytes.NewReader(buf[:n])).Decode(&request)
+			var body, packet bytes.Buffer
+			gob.NewEncoder(&body).Encode(&PingResponse{k.newHeader()})
+			gob.NewEncoder(&packet).Encode(&udpPacket{ID: request.ID, Method: request.Method, Reply: true, Body: body.Bytes()})
+			conn.WriteToUDP(packet.Bytes(), addr)
+		}
+	}()
+
+	client := NewUDPTransport()
+	client.Timeout = 50 * time.Millisecond
+	defer client.Close()
+
+	reply := PingResponse{}
+	if err := client.Call(context.Background(), me.address, "kademliaCore.Ping", &PingRequest{k.newHeader()}, &reply); err != nil {
+		t.Fatalf("Expected ping to succeed on retry: %s", err)
+	}
+	if !reply.Sender.id.Equals(me.id) {
+		t.Errorf("Expected reply from %s, received %s", me.id, reply.Sender.id)
+	}
+
+	// Resends are spread over the caller's deadline rather than waiting out
+	// a Timeout that would not fit in it
+	client.Timeout = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.Call(ctx, me.address, "kademliaCore.Ping", &PingRequest{k.newHeader()}, &reply); err != nil {
+		t.Errorf("Expected ping to be resent within its deadline: %s", err)
+	}
+
+	client.Timeout = 50 * time.Millisecond
+	client.Retries = 0
+	if err := client.Call(context.Background(), me.address, "kademliaCore.Ping", &PingRequest{k.newHeader()}, &reply); err == nil {
+		t.Errorf("Expected ping to time out without retries")
+	}
+}
+
+func TestUDPTransportSpoofedReply(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	impostor, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impostor.Close()
+
+	// A peer that never answers, while another socket answers in its place
+	k := newTestNode(conn.LocalAddr().String())
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var request udpPacket
+			gob.NewDecoder(bytes.NewReader(buf[:n])).Decode(&request)
+			var body, packet bytes.Buffer
+			gob.NewEncoder(&body).Encode(&PingResponse{k.newHeader()})
+			gob.NewEncoder(&packet).Encode(&udpPacket{ID: request.ID, Method: request.Method, Reply: true, Body: body.Bytes()})
+			impostor.WriteToUDP(packet.Bytes(), addr)
+		}
+	}()
+
+	client := NewUDPTransport()
+	client.Timeout = 50 * time.Millisecond
+	client.Retries = 1
+	defer client.Close()
+	if err := client.Call(context.Background(), conn.LocalAddr().String(), "kademliaCore.Ping", &PingRequest{k.newHeader()}, &PingResponse{}); err == nil {
+		t.Errorf("Expected a reply from another address to be ignored")
+	}
+}
+
+func TestJoinPutGetUDP(t *testing.T) {
+	nodes := make([]*Kademlia, 5)
+	for i := range nodes {
+		nodes[i] = newTestNode(fmt.Sprintf("127.0.0.1:%d", 9080+i))
+		nodes[i].Difficulty = testDifficulty
+		nodes[i].Transport = NewUDPTransport()
+		defer nodes[i].Close()
+	}
+
+	if err := nodes[0].Join(context.Background()); err != nil {
+		t.Fatalf("Error starting network: %s", err)
+	}
+	for i := 1; i < len(nodes); i++ {
+		if err := nodes[i].Join(context.Background(), NewContact(NodeID{}, nodes[i-1].routes.node.address)); err != nil {
+			t.Fatalf("Error joining node %d: %s", i, err)
+		}
+	}
+
+	ip := net.ParseIP("74.125.224.72")
+	register(t, nodes[len(nodes)-1], "www.google.com")
+	if err := nodes[len(nodes)-1].Put(context.Background(), testKey, "www.google.com", "A", Record{IP: ip}); err != nil {
+		t.Errorf("Error putting www.google.com: %s", err)
+	}
+	for i, k := range nodes {
+		if found, err := k.Get(context.Background(), "www.google.com", "A"); err != nil || !onlyIP(found).Equal(ip) {
+			t.Errorf("Node %d expected %s for www.google.com, received %v (%v)", i, ip, found, err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import(
+  "io"
+  "context"
+  "fmt"
+  "log"
+  "net"
+  "time"
+  "encoding/binary"
+
+  "github.com/CodingAnarchy/dominion/lib/dns"
+  "github.com/CodingAnarchy/dominion/lib/kademlia"
+)
+
+// tcpIdleTimeout is how long a TCP client may stay silent before we hang up
+const tcpIdleTimeout = 10 * time.Second
+
+// servedTypes are the record types held in the DHT, the only ones queries
+// are answered for
+var servedTypes = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeNS, dns.TypeMX, dns.TypeTXT, dns.TypeSRV, dns.TypeCAA}
+
+// queryTimeout bounds the DHT lookups made to answer one query, so that a
+// client is told of a failure before it gives up on us
+const queryTimeout = 4 * time.Second
+
+// maxAliases limits how many CNAME records are followed for one query
+const maxAliases = 8
+
+// resolve answers a single DNS query by looking its records up in the DHT,
+// following CNAME records to the records of their targets.  Names without a
+// registration do not exist; registered names without records of the type
+// get an empty answer.
+func resolve(query *dns.Message) (reply *dns.Message) {
+  reply = dns.NewReply(query)
+  reply.Authoritative = true
+  if query.Opcode != dns.OpcodeQuery {
+    reply.Rcode = dns.RcodeNotImplemented
+    return
+  }
+  if len(query.Questions) != 1 {
+    reply.Rcode = dns.RcodeFormatError
+    return
+  }
+
+  q := query.Questions[0]
+  if q.Class != dns.ClassINET {
+    reply.Rcode = dns.RcodeRefused
+    return
+  }
+  if !served(q.Type) {
+    // Types the DHT cannot hold are refused without looking anything up
+    reply.Rcode = dns.RcodeNotImplemented
+    return
+  }
+
+  ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+  defer cancel()
+  var err error
+  name := q.Name
+  for aliases := 0; ; aliases++ {
+    found := len(reply.Answers)
+    if reply.Answers, _, err = appendAnswers(ctx, reply.Answers, name, q.Type); err != nil || len(reply.Answers) > found || q.Type == dns.TypeCNAME || aliases == maxAliases {
+      break
+    }
+
+    var alias []kademlia.Record
+    if reply.Answers, alias, err = appendAnswers(ctx, reply.Answers, name, dns.TypeCNAME); err != nil || len(alias) == 0 {
+      break
+    }
+    name = alias[0].Host
+  }
+
+  if err == nil && len(reply.Answers) == 0 {
+    if _, err = node.Registration(ctx, q.Name); err == kademlia.ErrNotRegistered {
+      reply.Rcode = dns.RcodeNameError
+      err = nil
+    }
+  }
+  if err != nil {
+    log.Println("Error looking up", q.Name, dns.TypeString(q.Type), ": ", err)
+    reply.Answers = nil
+    reply.Rcode = dns.RcodeServerFailure
+  }
+  return
+}
+
+// served reports whether records of a type are held in the DHT.
+func served(typ uint16) bool {
+  for _, t := range servedTypes {
+    if t == typ {
+      return true
+    }
+  }
+  return false
+}
+
+// appendAnswers looks up the records of one type for name in the DHT and
+// appends them to answers in wire format.
+func appendAnswers(ctx context.Context, answers []dns.Resource, name string, typ uint16) ([]dns.Resource, []kademlia.Record, error) {
+  records, err := node.Get(ctx, name, dns.TypeString(typ))
+  if err == kademlia.ErrNotFound {
+    return answers, nil, nil
+  } else if err != nil {
+    return answers, nil, err
+  }
+  for i := range records {
+    answer, err := resource(name, typ, &records[i])
+    if err != nil {
+      return answers, nil, err
+    }
+    answers = append(answers, answer)
+  }
+  return answers, records, nil
+}
+
+// resource converts a record from the DHT to wire format.
+func resource(name string, typ uint16, record *kademlia.Record) (dns.Resource, error) {
+  ttl := uint32(record.TTL / time.Second)
+  switch typ {
+  case dns.TypeA, dns.TypeAAAA:
+    return dns.AddressRecord(name, ttl, record.IP), nil
+  case dns.TypeCNAME, dns.TypeNS:
+    return dns.NameRecord(name, typ, ttl, record.Host)
+  case dns.TypeMX:
+    return dns.MXRecord(name, ttl, record.Priority, record.Host)
+  case dns.TypeSRV:
+    return dns.SRVRecord(name, ttl, record.Priority, record.Weight, record.Port, record.Host)
+  case dns.TypeTXT:
+    return dns.TXTRecord(name, ttl, record.Text)
+  case dns.TypeCAA:
+    return dns.CAARecord(name, ttl, record.Flags, record.Tag, record.Value)
+  }
+  return dns.Resource{}, fmt.Errorf("Unsupported record type %s", dns.TypeString(typ))
+}
+
+// answer builds the wire format reply to a wire format query, no longer than
+// limit bytes if limit is positive.  It returns nil for responses, which are
+// never replied to lest two servers bounce messages between them or a forged
+// source address turn us against a third party, and for messages too broken
+// to reply to.
+func answer(msg []byte, limit int) []byte {
+  if len(msg) > 2 && msg[2]&0x80 != 0 {
+    // The QR bit is set
+    return nil
+  }
+  var reply *dns.Message
+  if query, err := dns.Unpack(msg); err == nil {
+    reply = resolve(query)
+  } else if len(msg) >= 2 {
+    reply = &dns.Message{Header: dns.Header{ID: binary.BigEndian.Uint16(msg), Response: true, Rcode: dns.RcodeFormatError}}
+  } else {
+    return nil
+  }
+
+  out, err := reply.Pack()
+  if err == nil && limit > 0 && len(out) > limit {
+    // Tell the client to retry over TCP
+    reply.Truncated = true
+    reply.Answers, reply.Authorities, reply.Additionals = nil, nil, nil
+    out, err = reply.Pack()
+  }
+  if err != nil {
+    log.Println("Error packing reply: ", err)
+    return nil
+  }
+  return out
+}
+
+// serveUDP answers queries arriving on conn until it is closed.
+func serveUDP(conn net.PacketConn) {
+  buf := make([]byte, 65535)
+  for {
+    n, addr, err := conn.ReadFrom(buf)
+    if err != nil {
+      log.Println("Error reading UDP query: ", err)
+      return
+    }
+    msg := append([]byte(nil), buf[:n]...)
+    go func() {
+      if reply := answer(msg, dns.MaxUDPSize); reply != nil {
+        conn.WriteTo(reply, addr)
+      }
+    }()
+  }
+}
+
+// serveTCP accepts TCP clients on listener until it is closed.
+func serveTCP(listener net.Listener) {
+  for {
+    conn, err := listener.Accept()
+    if err != nil {
+      log.Println("Error accepting connection: ", err)
+      return
+    }
+    go handleConnection(conn)
+  }
+}
+
+// handleConnection answers length-prefixed queries from a TCP client until
+// it hangs up or goes idle.
+func handleConnection(conn net.Conn) {
+  defer conn.Close()
+  for {
+    conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+    var length uint16
+    if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+      if err != io.EOF {
+        log.Println("Error receiving from client", conn.RemoteAddr(), ": ", err)
+      }
+      return
+    }
+    msg := make([]byte, length)
+    if _, err := io.ReadFull(conn, msg); err != nil {
+      log.Println("Error receiving from client", conn.RemoteAddr(), ": ", err)
+      return
+    }
+
+    reply := answer(msg, 0)
+    if reply == nil {
+      return
+    }
+    if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(reply))), reply...)); err != nil {
+      log.Println("Error replying to client", conn.RemoteAddr(), ": ", err)
+      return
+    }
+  }
+}
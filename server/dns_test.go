@@ -0,0 +1,248 @@
+package main
+
+import(
+  "io"
+  "net"
+  "bytes"
+  "strings"
+  "testing"
+  "context"
+  "crypto/ed25519"
+  "encoding/binary"
+
+  "github.com/CodingAnarchy/dominion/lib/dns"
+  "github.com/CodingAnarchy/dominion/lib/kademlia"
+)
+
+// testDifficulty keeps the puzzles and proof-of-work in tests quick
+const testDifficulty = 4
+
+// startNode starts the DHT node queries are resolved through, alone on a
+// simulated network, and publishes the given records for each name.
+func startNode(t *testing.T, names map[string]map[string][]kademlia.Record) {
+  t.Helper()
+  key, err := kademlia.NewNodeKey(testDifficulty)
+  if err != nil {
+    t.Fatal(err)
+  }
+  node = kademlia.NewKademlia(key, "node", "test")
+  node.NodeDifficulty, node.Difficulty = testDifficulty, testDifficulty
+  node.Transport = kademlia.NewSimNetwork(1).NewTransport()
+  if err := node.Join(context.Background()); err != nil {
+    t.Fatalf("Error starting node: %s", err)
+  }
+  t.Cleanup(func() {
+    node.Close()
+    node = nil
+  })
+
+  _, owner, _ := ed25519.GenerateKey(nil)
+  for name, sets := range names {
+    if err := node.Register(context.Background(), owner, name, *lifetime); err != nil {
+      t.Fatalf("Error registering %s: %s", name, err)
+    }
+    for typ, records := range sets {
+      if err := node.Put(context.Background(), owner, name, typ, records...); err != nil {
+        t.Fatalf("Error putting %s records for %s: %s", typ, name, err)
+      }
+    }
+  }
+}
+
+// query builds a standard query for one name and type.
+func query(name string, typ uint16) *dns.Message {
+  return &dns.Message{
+    Header:    dns.Header{ID: 0x1234, RecursionDesired: true},
+    Questions: []dns.Question{{Name: name, Type: typ, Class: dns.ClassINET}},
+  }
+}
+
+func TestResolve(t *testing.T) {
+  startNode(t, map[string]map[string][]kademlia.Record{
+    "example.com":      {"A": {{IP: net.ParseIP("93.184.216.34")}}},
+    "www.example.com":  {"CNAME": {{Host: "example.com"}}},
+    "bare.example.com": {},
+  })
+
+  tests := []struct {
+    name    string
+    typ     uint16
+    rcode   uint8
+    answers []uint16
+  }{
+    {"example.com.", dns.TypeA, dns.RcodeSuccess, []uint16{dns.TypeA}},
+    {"EXAMPLE.com.", dns.TypeA, dns.RcodeSuccess, []uint16{dns.TypeA}},
+    {"www.example.com.", dns.TypeA, dns.RcodeSuccess, []uint16{dns.TypeCNAME, dns.TypeA}},
+    {"www.example.com.", dns.TypeCNAME, dns.RcodeSuccess, []uint16{dns.TypeCNAME}},
+    // Registered names without records of the type have no data
+    {"example.com.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+    {"bare.example.com.", dns.TypeA, dns.RcodeSuccess, nil},
+    // Names without a registration do not exist
+    {"missing.example.com.", dns.TypeA, dns.RcodeNameError, nil},
+    {"missing.example.com.", dns.TypeMX, dns.RcodeNameError, nil},
+  }
+  for _, test := range tests {
+    reply := resolve(query(test.name, test.typ))
+    if reply.ID != 0x1234 || !reply.Response || !reply.Authoritative || reply.Rcode != test.rcode {
+      t.Errorf("%s %s: expected rcode %d, obtained header %+v", test.name, dns.TypeString(test.typ), test.rcode, reply.Header)
+    }
+    if len(reply.Answers) != len(test.answers) {
+      t.Errorf("%s %s: expected %d answers, obtained %d", test.name, dns.TypeString(test.typ), len(test.answers), len(reply.Answers))
+      continue
+    }
+    for i, a := range reply.Answers {
+      if a.Type != test.answers[i] {
+        t.Errorf("%s %s: expected answer %d of type %s, obtained %s", test.name, dns.TypeString(test.typ), i, dns.TypeString(test.answers[i]), dns.TypeString(a.Type))
+      }
+    }
+  }
+}
+
+func TestResolveRefused(t *testing.T) {
+  // No node is running, so any of these reaching the DHT would panic
+  node = nil
+
+  update := query("example.com.", dns.TypeA)
+  update.Opcode = 5
+  chaos := query("example.com.", dns.TypeA)
+  chaos.Questions[0].Class = 3
+  double := query("example.com.", dns.TypeA)
+  double.Questions = append(double.Questions, double.Questions[0])
+
+  tests := []struct {
+    name  string
+    query *dns.Message
+    rcode uint8
+  }{
+    {"SOA query", query("example.com.", dns.TypeSOA), dns.RcodeNotImplemented},
+    {"ANY query", query("example.com.", dns.TypeANY), dns.RcodeNotImplemented},
+    {"OPT query", query("example.com.", dns.TypeOPT), dns.RcodeNotImplemented},
+    {"update", update, dns.RcodeNotImplemented},
+    {"CHAOS class", chaos, dns.RcodeRefused},
+    {"two questions", double, dns.RcodeFormatError},
+  }
+  for _, test := range tests {
+    if reply := resolve(test.query); reply.Rcode != test.rcode || len(reply.Answers) != 0 {
+      t.Errorf("%s: expected rcode %d and no answers, obtained %d and %d", test.name, test.rcode, reply.Rcode, len(reply.Answers))
+    }
+  }
+}
+
+// pack packs a query for one name and type to wire format.
+func pack(t *testing.T, name string, typ uint16, id uint16) []byte {
+  t.Helper()
+  q := query(name, typ)
+  q.ID = id
+  msg, err := q.Pack()
+  if err != nil {
+    t.Fatalf("Error packing query: %s", err)
+  }
+  return msg
+}
+
+func TestAnswer(t *testing.T) {
+  // Enough text that the answer cannot fit in a UDP reply
+  text := []kademlia.Record{
+    {Text: []string{strings.Repeat("a", 200)}},
+    {Text: []string{strings.Repeat("b", 200)}},
+    {Text: []string{strings.Repeat("c", 200)}},
+  }
+  startNode(t, map[string]map[string][]kademlia.Record{
+    "example.com": {"A": {{IP: net.ParseIP("93.184.216.34")}}, "TXT": text},
+  })
+
+  tests := []struct {
+    name      string
+    msg       []byte
+    limit     int
+    rcode     uint8
+    answers   int
+    truncated bool
+  }{
+    {"small UDP reply", pack(t, "example.com.", dns.TypeA, 1), dns.MaxUDPSize, dns.RcodeSuccess, 1, false},
+    {"large UDP reply", pack(t, "example.com.", dns.TypeTXT, 2), dns.MaxUDPSize, dns.RcodeSuccess, 0, true},
+    {"large TCP reply", pack(t, "example.com.", dns.TypeTXT, 3), 0, dns.RcodeSuccess, len(text), false},
+    {"malformed query", []byte{0x00, 0x04, 0x01}, dns.MaxUDPSize, dns.RcodeFormatError, 0, false},
+  }
+  for _, test := range tests {
+    out := answer(test.msg, test.limit)
+    if test.limit > 0 && len(out) > test.limit {
+      t.Errorf("%s: expected at most %d bytes, obtained %d", test.name, test.limit, len(out))
+    }
+    reply, err := dns.Unpack(out)
+    if err != nil {
+      t.Errorf("%s: error unpacking reply: %s", test.name, err)
+      continue
+    }
+    if reply.ID != binary.BigEndian.Uint16(test.msg) || !reply.Response {
+      t.Errorf("%s: expected a reply to query %d, obtained header %+v", test.name, binary.BigEndian.Uint16(test.msg), reply.Header)
+    }
+    if reply.Rcode != test.rcode || reply.Truncated != test.truncated || len(reply.Answers) != test.answers {
+      t.Errorf("%s: expected rcode %d, truncated %t and %d answers, obtained %d, %t and %d", test.name,
+        test.rcode, test.truncated, test.answers, reply.Rcode, reply.Truncated, len(reply.Answers))
+    }
+  }
+
+  // A message too short to hold an ID cannot be replied to at all
+  if out := answer([]byte{0x00}, dns.MaxUDPSize); out != nil {
+    t.Errorf("Expected no reply to a one byte message, obtained %x", out)
+  }
+
+  // Nor is a response, well formed or not
+  response := query("example.com.", dns.TypeA)
+  response.Response = true
+  msg, err := response.Pack()
+  if err != nil {
+    t.Fatalf("Error packing response: %s", err)
+  }
+  if out := answer(msg, dns.MaxUDPSize); out != nil {
+    t.Errorf("Expected no reply to a response, obtained %x", out)
+  }
+  if out := answer([]byte{0x00, 0x04, 0x80}, dns.MaxUDPSize); out != nil {
+    t.Errorf("Expected no reply to a malformed response, obtained %x", out)
+  }
+}
+
+func TestHandleConnection(t *testing.T) {
+  startNode(t, map[string]map[string][]kademlia.Record{
+    "example.com": {"A": {{IP: net.ParseIP("93.184.216.34")}}},
+  })
+  client, server := net.Pipe()
+  done := make(chan struct{})
+  go func() {
+    handleConnection(server)
+    close(done)
+  }()
+
+  // Queries are framed by a two byte length, and may arrive together
+  var frames []byte
+  ids := []uint16{1, 2}
+  for _, id := range ids {
+    msg := pack(t, "example.com.", dns.TypeA, id)
+    frames = append(binary.BigEndian.AppendUint16(frames, uint16(len(msg))), msg...)
+  }
+  go client.Write(frames)
+
+  for _, id := range ids {
+    var length uint16
+    if err := binary.Read(client, binary.BigEndian, &length); err != nil {
+      t.Fatalf("Error reading reply length: %s", err)
+    }
+    msg := make([]byte, length)
+    if _, err := io.ReadFull(client, msg); err != nil {
+      t.Fatalf("Error reading reply: %s", err)
+    }
+    reply, err := dns.Unpack(msg)
+    if err != nil {
+      t.Fatalf("Error unpacking reply: %s", err)
+    }
+    if reply.ID != id || len(reply.Answers) != 1 || !reply.Answers[0].IP().Equal(net.ParseIP("93.184.216.34")) {
+      t.Errorf("Expected reply %d with the address of example.com, obtained %+v", id, reply)
+    }
+  }
+
+  // A frame cut short ends the connection
+  client.Write(append(binary.BigEndian.AppendUint16(nil, 100), bytes.Repeat([]byte{0}, 10)...))
+  client.Close()
+  <-done
+}
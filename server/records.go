@@ -0,0 +1,210 @@
+package main
+
+import(
+  "os"
+  "fmt"
+  "net"
+  "time"
+  "bufio"
+  "strconv"
+  "strings"
+  "context"
+
+  "github.com/CodingAnarchy/dominion/lib/kademlia"
+)
+
+// setKey names the record set for one domain and type
+type setKey struct {
+  domain, typ string
+}
+
+// recordSets collects records into the sets they are published as, keeping
+// the order the sets were first seen in.
+type recordSets struct {
+  order []setKey
+  sets  map[setKey][]kademlia.Record
+}
+
+func (r *recordSets) add(domain string, typ string, record kademlia.Record) {
+  key := setKey{strings.ToLower(strings.TrimSuffix(domain, ".")), strings.ToUpper(typ)}
+  if r.sets == nil {
+    r.sets = make(map[setKey][]kademlia.Record)
+  }
+  if r.sets[key] == nil {
+    r.order = append(r.order, key)
+  }
+  r.sets[key] = append(r.sets[key], record)
+}
+
+// publishRecords signs the records from the -publish and -records flags with
+// the key from the -key flag and stores them in the DHT, first registering
+// each name to the key.  Records for the same name and type are published
+// together as one set.
+func publishRecords() error {
+  var sets recordSets
+  if *publish != "" {
+    for _, entry := range strings.Split(*publish, ",") {
+      record, domain, err := parseAddressRecord(strings.TrimSpace(entry))
+      if err != nil {
+        return err
+      }
+      if record.IP.To4() != nil {
+        sets.add(domain, "A", record)
+      } else {
+        sets.add(domain, "AAAA", record)
+      }
+    }
+  }
+  if *records != "" {
+    if err := loadRecords(*records, &sets); err != nil {
+      return err
+    }
+  }
+
+  if len(sets.order) == 0 {
+    return nil
+  }
+  owner, err := kademlia.LoadKey(*keyFile)
+  if err != nil {
+    return err
+  }
+  registered := make(map[string]bool)
+  for _, key := range sets.order {
+    if !registered[key.domain] {
+      if err := node.Register(context.Background(), owner, key.domain, *lifetime); err != nil {
+        return fmt.Errorf("Error registering %s: %s", key.domain, err)
+      }
+      registered[key.domain] = true
+      fmt.Println("Registered", key.domain, "for", *lifetime)
+    }
+    if err := node.Put(context.Background(), owner, key.domain, key.typ, sets.sets[key]...); err != nil {
+      return fmt.Errorf("Error publishing %s records for %s: %s", key.typ, key.domain, err)
+    }
+    fmt.Println("Published", len(sets.sets[key]), key.typ, "records for", key.domain)
+  }
+  return nil
+}
+
+// parseAddressRecord parses a domain=ip entry with an optional /ttl suffix,
+// such as example.com=93.184.216.119/1h.
+func parseAddressRecord(entry string) (record kademlia.Record, domain string, err error) {
+  parts := strings.SplitN(entry, "=", 2)
+  if len(parts) != 2 {
+    return record, "", fmt.Errorf("Invalid record %q, expected domain=ip[/ttl]", entry)
+  }
+  address := parts[1]
+  if slash := strings.LastIndex(address, "/"); slash >= 0 {
+    if record.TTL, err = time.ParseDuration(address[slash+1:]); err != nil {
+      return record, "", fmt.Errorf("Invalid TTL in record %q: %s", entry, err)
+    }
+    address = address[:slash]
+  }
+  if record.IP = net.ParseIP(address); record.IP == nil {
+    return record, "", fmt.Errorf("Invalid address in record %q", entry)
+  }
+  return record, parts[0], nil
+}
+
+// loadRecords reads records from a file in a simplified zone file format:
+// one "name [ttl] type data" record per line, with the TTL in seconds and
+// the data written as in a zone file.  Blank lines and lines starting with #
+// or ; are skipped.
+func loadRecords(path string, sets *recordSets) (err error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return
+  }
+  defer file.Close()
+
+  scanner := bufio.NewScanner(file)
+  for line := 1; scanner.Scan(); line++ {
+    text := strings.TrimSpace(scanner.Text())
+    if text == "" || text[0] == '#' || text[0] == ';' {
+      continue
+    }
+    fields, err := splitFields(text)
+    if err == nil {
+      var domain, typ string
+      var record kademlia.Record
+      if domain, typ, record, err = parseRecordFields(fields); err == nil {
+        sets.add(domain, typ, record)
+        continue
+      }
+    }
+    return fmt.Errorf("%s:%d: %s", path, line, err)
+  }
+  return scanner.Err()
+}
+
+// splitFields splits a line at whitespace, keeping double quoted strings
+// such as TXT data together.
+func splitFields(line string) (fields []string, err error) {
+  for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+    if line[0] != '"' {
+      end := strings.IndexAny(line, " \t")
+      if end < 0 {
+        end = len(line)
+      }
+      fields = append(fields, line[:end])
+      line = line[end:]
+      continue
+    }
+
+    quoted, err := strconv.QuotedPrefix(line)
+    if err != nil {
+      return nil, fmt.Errorf("Unterminated string in %q", line)
+    }
+    field, _ := strconv.Unquote(quoted)
+    fields = append(fields, field)
+    line = line[len(quoted):]
+  }
+  return
+}
+
+// parseRecordFields builds a record from the fields of one line of a records file.
+func parseRecordFields(fields []string) (domain string, typ string, record kademlia.Record, err error) {
+  if len(fields) < 3 {
+    return "", "", record, fmt.Errorf("Expected name [ttl] type data")
+  }
+  domain, fields = fields[0], fields[1:]
+  if ttl, err := strconv.ParseUint(fields[0], 10, 31); err == nil {
+    record.TTL = time.Duration(ttl) * time.Second
+    fields = fields[1:]
+  }
+  typ, data := strings.ToUpper(fields[0]), fields[1:]
+
+  // The number of data fields each type takes, and how many of them lead
+  // with numbers
+  wanted := map[string]int{"A": 1, "AAAA": 1, "CNAME": 1, "NS": 1, "MX": 2, "SRV": 4, "CAA": 3}
+  numeric := map[string]int{"MX": 1, "SRV": 3, "CAA": 1}
+  if n, ok := wanted[typ]; ok && len(data) != n {
+    return "", "", record, fmt.Errorf("Expected %d data fields for %s record, found %d", n, typ, len(data))
+  }
+  numbers := make([]uint64, numeric[typ])
+  for i := range numbers {
+    if numbers[i], err = strconv.ParseUint(data[i], 10, 16); err != nil {
+      return "", "", record, fmt.Errorf("Invalid number %q in %s record", data[i], typ)
+    }
+  }
+
+  switch typ {
+  case "A", "AAAA":
+    record.IP = net.ParseIP(data[0])
+  case "CNAME", "NS":
+    record.Host = data[0]
+  case "MX":
+    record.Priority, record.Host = uint16(numbers[0]), data[1]
+  case "SRV":
+    record.Priority, record.Weight, record.Port, record.Host = uint16(numbers[0]), uint16(numbers[1]), uint16(numbers[2]), data[3]
+  case "TXT":
+    record.Text = data
+  case "CAA":
+    if numbers[0] > 255 {
+      return "", "", record, fmt.Errorf("Invalid CAA flags %d", numbers[0])
+    }
+    record.Flags, record.Tag, record.Value = uint8(numbers[0]), data[1], data[2]
+  default:
+    return "", "", record, fmt.Errorf("Unsupported record type %s", typ)
+  }
+  return
+}
@@ -0,0 +1,86 @@
+package main
+
+import(
+  "net"
+  "time"
+  "reflect"
+  "testing"
+
+  "github.com/CodingAnarchy/dominion/lib/kademlia"
+)
+
+func TestSplitFields(t *testing.T) {
+  tests := []struct {
+    line   string
+    fields []string
+  }{
+    {"example.com A 93.184.216.34", []string{"example.com", "A", "93.184.216.34"}},
+    {"  example.com \t300   A\t93.184.216.34  ", []string{"example.com", "300", "A", "93.184.216.34"}},
+    {`example.com TXT "v=spf1 -all"`, []string{"example.com", "TXT", "v=spf1 -all"}},
+    {`example.com TXT "one" "two \"quoted\""`, []string{"example.com", "TXT", "one", `two "quoted"`}},
+    {`example.com CAA 0 issue "letsencrypt.org"`, []string{"example.com", "CAA", "0", "issue", "letsencrypt.org"}},
+    {"", nil},
+  }
+  for _, test := range tests {
+    fields, err := splitFields(test.line)
+    if err != nil {
+      t.Errorf("%q: unexpected error %s", test.line, err)
+    } else if !reflect.DeepEqual(fields, test.fields) {
+      t.Errorf("%q: expected %q, obtained %q", test.line, test.fields, fields)
+    }
+  }
+
+  if _, err := splitFields(`example.com TXT "unterminated`); err == nil {
+    t.Errorf("Expected error for an unterminated string")
+  }
+}
+
+func TestParseRecordFields(t *testing.T) {
+  tests := []struct {
+    fields []string
+    domain string
+    typ    string
+    record kademlia.Record
+  }{
+    {[]string{"example.com", "A", "93.184.216.34"}, "example.com", "A",
+      kademlia.Record{IP: net.ParseIP("93.184.216.34")}},
+    {[]string{"example.com", "3600", "aaaa", "2606:2800:220:1::1"}, "example.com", "AAAA",
+      kademlia.Record{TTL: time.Hour, IP: net.ParseIP("2606:2800:220:1::1")}},
+    {[]string{"www.example.com", "CNAME", "example.com"}, "www.example.com", "CNAME",
+      kademlia.Record{Host: "example.com"}},
+    {[]string{"example.com", "NS", "ns1.example.com"}, "example.com", "NS",
+      kademlia.Record{Host: "ns1.example.com"}},
+    {[]string{"example.com", "MX", "10", "mail.example.com"}, "example.com", "MX",
+      kademlia.Record{Priority: 10, Host: "mail.example.com"}},
+    {[]string{"_sip._tcp.example.com", "SRV", "1", "5", "5060", "sip.example.com"}, "_sip._tcp.example.com", "SRV",
+      kademlia.Record{Priority: 1, Weight: 5, Port: 5060, Host: "sip.example.com"}},
+    {[]string{"example.com", "TXT", "v=spf1 -all", "second"}, "example.com", "TXT",
+      kademlia.Record{Text: []string{"v=spf1 -all", "second"}}},
+    {[]string{"example.com", "CAA", "128", "issue", "letsencrypt.org"}, "example.com", "CAA",
+      kademlia.Record{Flags: 128, Tag: "issue", Value: "letsencrypt.org"}},
+  }
+  for _, test := range tests {
+    domain, typ, record, err := parseRecordFields(test.fields)
+    if err != nil {
+      t.Errorf("%q: unexpected error %s", test.fields, err)
+    } else if domain != test.domain || typ != test.typ || !reflect.DeepEqual(record, test.record) {
+      t.Errorf("%q: expected %s %s %+v, obtained %s %s %+v", test.fields, test.domain, test.typ, test.record, domain, typ, record)
+    }
+  }
+
+  invalid := [][]string{
+    {"example.com", "A"},
+    {"example.com", "A", "93.184.216.34", "extra"},
+    {"example.com", "MX", "mail.example.com"},
+    {"example.com", "MX", "high", "mail.example.com"},
+    {"example.com", "MX", "65536", "mail.example.com"},
+    {"example.com", "SRV", "1", "5", "sip.example.com"},
+    {"example.com", "CAA", "256", "issue", "letsencrypt.org"},
+    {"example.com", "SOA", "ns1.example.com"},
+  }
+  for _, fields := range invalid {
+    if _, _, _, err := parseRecordFields(fields); err == nil {
+      t.Errorf("%q: expected error", fields)
+    }
+  }
+}
@@ -1,59 +1,139 @@
 package main
 
 import(
+  "os"
   "log"
   "fmt"
   "net"
-  "bufio"
-  "strings"
+  "flag"
+  "time"
+  "context"
+  "syscall"
+  "os/signal"
+
+  "github.com/CodingAnarchy/dominion/lib/kademlia"
+)
+
+// node is the DHT node queries are resolved through
+var node *kademlia.Kademlia
+
+var (
+  dnsAddr   = flag.String("listen", ":8053", "address to answer DNS queries on, over both UDP and TCP")
+  dhtAddr   = flag.String("dht", "127.0.0.1:4000", "address to serve the Kademlia DHT on")
+  networkID = flag.String("network", "dominion", "Kademlia network ID to join")
+  seedList  = flag.String("seeds", "", "comma separated bootstrap contacts, as address or nodeid@address")
+  seedFile  = flag.String("seedfile", "", "file of bootstrap contacts, one per line")
+  routeFile = flag.String("routes", "dominion.routes", "file to save the routing table to, and rejoin from on restart; empty to disable")
+  nodeKey   = flag.String("nodekey", "dominion.nodekey", "file holding the key the node's DHT id is derived from, created if missing")
+  transport = flag.String("transport", "rpc", "DHT transport to use: rpc (net/rpc over HTTP) or udp")
+  paths     = flag.Int("paths", 1, "disjoint paths each DHT lookup takes, to tolerate hostile nodes; 1 for plain Kademlia lookups")
+  store     = flag.String("store", "memory", "where to keep DHT records: memory (lost on exit) or log (saved to -storefile)")
+  storeFile = flag.String("storefile", "dominion.log", "file to save DHT records to with -store=log")
+  publish   = flag.String("publish", "", "comma separated domain=ip[/ttl] address records to publish to the DHT")
+  keyFile   = flag.String("key", "dominion.key", "file holding the key that owns published records, created if missing")
+  records   = flag.String("records", "", "file of records to publish to the DHT, one \"name [ttl] type data\" per line")
+  lifetime  = flag.Duration("lifetime", 30 * 24 * time.Hour, "how long to register published domains for")
 )
 
-var domains map[string]net.IP
-var client int
-
-func handleConnection(conn net.Conn) {
-  loc_client := client
-  client++
-  reader := bufio.NewReader(conn)
-  writer := bufio.NewWriter(conn)
-  var ip string
-  fmt.Println("Reading from connection...")
-  for {
-    msg, err := reader.ReadString('\n')
+// loadSeeds collects bootstrap contacts from the -seeds and -seedfile flags.
+func loadSeeds() (seeds []kademlia.Contact, err error) {
+  if seeds, err = kademlia.ParseSeedList(*seedList); err != nil {
+    return
+  }
+  if *seedFile != "" {
+    fromFile, err := kademlia.LoadSeeds(*seedFile)
     if err != nil {
-      log.Println("Error receiving from client", loc_client, ": ", err)
-      return
-    }
-    msg = strings.TrimSuffix(msg, "\n")
-    if addr, ok := domains[msg]; ok {
-      ip = addr.String()
-    } else {
-      ip = "Domain not found."
+      return nil, err
     }
-    writer.WriteString(fmt.Sprint(ip, "\n"))
-    writer.Flush()
+    seeds = append(seeds, fromFile...)
   }
+  return
 }
 
 func main() {
+  flag.Parse()
   fmt.Println("Server starting...")
-  client = 1
-  fmt.Println("Creating map of domains to IP addresses...")
-  domains = make(map[string]net.IP)
-  domains["www.google.com"] = net.ParseIP("74.125.224.72")
-  domains["www.facebook.com"] = net.ParseIP("69.63.176.13")
-  domains["example.com"] = net.ParseIP("93.184.216.119")
-  listener, err := net.Listen("tcp", ":8080")
+
+  seeds, err := loadSeeds()
   if err != nil {
-    log.Fatal(err)
+    log.Fatal("Error loading seeds: ", err)
   }
-  fmt.Println("Listening on TCP port 8080...")
-  for {
-    conn, err := listener.Accept()
-    if err != nil {
-      log.Fatal("Error accepting connection: ", err)
+  var routes kademlia.SavedRoutes
+  if *routeFile != "" {
+    if routes, err = kademlia.LoadRoutes(*routeFile); err != nil {
+      log.Fatal("Error loading routing table: ", err)
+    }
+  }
+  // Keep our place in the keyspace across restarts; a new key takes a while
+  // to find, since its id must solve the network's puzzle
+  key, err := kademlia.LoadNodeKey(*nodeKey, kademlia.DefaultNodeDifficulty)
+  if err != nil {
+    log.Fatal("Error loading node key: ", err)
+  }
+  node = kademlia.NewKademlia(key, *dhtAddr, *networkID)
+  node.RoutesFile = *routeFile
+  node.DisjointPaths = *paths
+  switch *transport {
+  case "rpc":
+  case "udp":
+    node.Transport = kademlia.NewUDPTransport()
+  default:
+    log.Fatal("Unknown transport: ", *transport)
+  }
+  switch *store {
+  case "memory":
+  case "log":
+    if node.Backend, err = kademlia.OpenLogBackend(*storeFile); err != nil {
+      log.Fatal("Error opening record log: ", err)
+    }
+  default:
+    log.Fatal("Unknown store: ", *store)
+  }
+  restored := 0
+  if len(routes.Contacts) > 0 {
+    if restored, err = node.Rejoin(context.Background(), routes.Contacts); err != nil {
+      log.Fatal("Error rejoining network: ", err)
+    }
+    fmt.Println("Rejoined through", restored, "of", len(routes.Contacts), "saved contacts")
+  }
+  if restored == 0 {
+    if err := node.Join(context.Background(), seeds...); err != nil {
+      log.Fatal("Error joining network: ", err)
+    }
+  }
+  self := node.Self()
+  if restored == 0 {
+    fmt.Println("Joined Kademlia network", *networkID, "as", self.String(), "with", len(seeds), "seeds...")
+  } else {
+    fmt.Println("Joined Kademlia network", *networkID, "as", self.String(), "from saved routes...")
+  }
+
+  // Close the node on the way out, so that it saves its routes and records
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+  go func() {
+    sig := <-signals
+    fmt.Println("Received", sig, "- shutting down...")
+    if err := node.Close(); err != nil {
+      log.Println("Error closing node: ", err)
     }
-    fmt.Println("Connection accepted to client", client, "...")
-    go handleConnection(conn)
+    os.Exit(0)
+  }()
+
+  if err := publishRecords(); err != nil {
+    log.Fatal("Error publishing records: ", err)
+  }
+
+  conn, err := net.ListenPacket("udp", *dnsAddr)
+  if err != nil {
+    log.Fatal(err)
+  }
+  listener, err := net.Listen("tcp", *dnsAddr)
+  if err != nil {
+    log.Fatal(err)
   }
+  fmt.Println("Answering DNS queries on", *dnsAddr, "over UDP and TCP...")
+  go serveTCP(listener)
+  serveUDP(conn)
+  node.Close()
 }